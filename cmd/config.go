@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+	ddgchat "github.com/nerdneilsfield/go-template/ddg-chat"
+	"github.com/spf13/cobra"
+)
+
+func newConfigCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "create, check and inspect config files",
+	}
+
+	cmd.AddCommand(newConfigInitCmd())
+	cmd.AddCommand(newConfigValidateCmd())
+	cmd.AddCommand(newConfigShowCmd())
+	return cmd
+}
+
+func newConfigInitCmd() *cobra.Command {
+	var force bool
+
+	cmd := &cobra.Command{
+		Use:          "init [config.toml]",
+		Short:        "write an annotated default config, use - for stdout",
+		Args:         cobra.MaximumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configPath := "config.toml"
+			if len(args) > 0 {
+				configPath = args[0]
+			}
+
+			if configPath == "-" {
+				_, err := fmt.Fprint(cmd.OutOrStdout(), ddgchat.DefaultConfigTemplate)
+				return err
+			}
+
+			if _, err := os.Stat(configPath); err == nil && !force {
+				return fmt.Errorf("%s already exists, use --force to overwrite", configPath)
+			}
+
+			if err := os.WriteFile(configPath, []byte(ddgchat.DefaultConfigTemplate), 0o644); err != nil {
+				return fmt.Errorf("failed to write config: %w", err)
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "wrote %s\n", configPath)
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVarP(&force, "force", "f", false, "overwrite an existing file")
+	return cmd
+}
+
+func newConfigValidateCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:          "validate <config.toml>",
+		Short:        "check a config file and report every problem",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			problems, err := ddgchat.CheckConfigFile(args[0])
+			if err != nil {
+				return err
+			}
+
+			if len(problems) == 0 {
+				fmt.Fprintf(cmd.OutOrStdout(), "%s: ok\n", args[0])
+				return nil
+			}
+
+			sort.SliceStable(problems, func(i, j int) bool {
+				return problems[i].Line < problems[j].Line
+			})
+			for _, problem := range problems {
+				location := args[0]
+				if problem.Line > 0 {
+					location = fmt.Sprintf("%s:%d", location, problem.Line)
+				}
+				problem.Line = 0
+				fmt.Fprintf(cmd.OutOrStdout(), "%s: %s\n", location, problem.String())
+			}
+			return fmt.Errorf("%s: %d problem(s) found", args[0], len(problems))
+		},
+	}
+}
+
+func newConfigShowCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "show [config.toml]",
+		Short:        "print the effective config with secrets redacted",
+		Long:         "Print the config run would use after applying the config file, DDG_CHAT_* environment variables and flags.",
+		Args:         cobra.MaximumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var configPath string
+			if len(args) > 0 {
+				configPath = args[0]
+			}
+
+			config, err := ddgchat.LoadConfig(configPath, configFlagOverrides(cmd.Flags()))
+			if err != nil {
+				return err
+			}
+
+			return toml.NewEncoder(cmd.OutOrStdout()).Encode(ddgchat.RedactConfig(config))
+		},
+	}
+
+	addConfigFlags(cmd.Flags())
+	return cmd
+}
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	ddgchat "github.com/nerdneilsfield/go-template/ddg-chat"
+	"github.com/spf13/pflag"
+)
+
+// configFlag keeps the raw flag value so it can be applied after the config
+// file and environment have been read.
+type configFlag struct {
+	field ddgchat.ConfigField
+	value string
+}
+
+func (f *configFlag) String() string { return f.value }
+
+func (f *configFlag) Set(value string) error {
+	f.value = value
+	return nil
+}
+
+func (f *configFlag) Type() string { return f.field.Type }
+
+// addConfigFlags registers one flag per config field.
+func addConfigFlags(flags *pflag.FlagSet) {
+	for _, field := range ddgchat.ConfigFields() {
+		flag := flags.VarPF(&configFlag{field: field}, field.Flag, "",
+			"override config key "+field.Key+" (env "+field.Env+")")
+		if field.Type == "bool" {
+			flag.NoOptDefVal = "true"
+		}
+	}
+}
+
+// configFlagOverrides returns an override applying every flag set on the
+// command line, for use with ddgchat.LoadConfig.
+func configFlagOverrides(flags *pflag.FlagSet) func(*ddgchat.Config) error {
+	return func(config *ddgchat.Config) error {
+		var err error
+		flags.Visit(func(flag *pflag.Flag) {
+			if f, ok := flag.Value.(*configFlag); ok && err == nil {
+				err = f.field.Set(config, f.value)
+			}
+		})
+		return err
+	}
+}
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 
 	loggerPkg "github.com/nerdneilsfield/shlogin/pkg/logger"
@@ -34,11 +35,14 @@ func newRootCmd(version string, buildTime string, gitCommit string) *cobra.Comma
 
 	cmd.AddCommand(newVersionCmd(version, buildTime, gitCommit))
 	cmd.AddCommand(newRunCmd())
+	cmd.AddCommand(newConfigCmd())
 	return cmd
 }
 
-func Execute(version string, buildTime string, gitCommit string) error {
-	if err := newRootCmd(version, buildTime, gitCommit).Execute(); err != nil {
+// Execute runs the root command. Cancelling ctx stops a running server
+// gracefully.
+func Execute(ctx context.Context, version string, buildTime string, gitCommit string) error {
+	if err := newRootCmd(version, buildTime, gitCommit).ExecuteContext(ctx); err != nil {
 		logger.Fatal("error executing root command: %w", zap.Error(err))
 		return fmt.Errorf("error executing root command: %w", err)
 	}
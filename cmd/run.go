@@ -7,19 +7,42 @@ import (
 )
 
 func newRunCmd() *cobra.Command {
-	return &cobra.Command{
-		Use:          "run",
-		Short:        "run ddg-chat",
-		Args:         cobra.ExactArgs(1),
+	cmd := &cobra.Command{
+		Use:   "run [config.toml]",
+		Short: "run ddg-chat",
+		Long: `Run the ddg-chat server.
+
+Settings are applied in this order, later ones win:
+  1. built-in defaults
+  2. the config file, if given
+  3. DDG_CHAT_* environment variables
+  4. command line flags
+
+Flags of type toml take a TOML array or inline table, e.g.
+  --hooks-rules '[{ stage = "request", action = "prepend", text = "Be brief." }]'`,
+		Args:         cobra.MaximumNArgs(1),
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			config, err := ddgchat.LoadConfig(args[0])
+			var configPath string
+			if len(args) > 0 {
+				configPath = args[0]
+			}
+
+			overrides := configFlagOverrides(cmd.Flags())
+			load := func() (*ddgchat.Config, error) {
+				return ddgchat.LoadConfig(configPath, overrides)
+			}
+
+			config, err := load()
 			if err != nil {
 				logger.Error("failed to load config", zap.Error(err))
 				return err
 			}
 
-			return ddgchat.RunServer(config)
+			return ddgchat.RunServer(cmd.Context(), ddgchat.NewConfigStore(configPath, config, load))
 		},
 	}
+
+	addConfigFlags(cmd.Flags())
+	return cmd
 }
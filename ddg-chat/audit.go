@@ -0,0 +1,188 @@
+package ddgchat
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+type AuditConfig struct {
+	Enabled bool `toml:"enabled"`
+	// "stdout" 或 "file"
+	Sink string `toml:"sink"`
+	// sink 为 file 时的文件路径和轮转设置
+	Path       string `toml:"path"`
+	MaxSizeMB  int    `toml:"max_size_mb"`
+	MaxBackups int    `toml:"max_backups"`
+	MaxAgeDays int    `toml:"max_age_days"`
+	Compress   bool   `toml:"compress"`
+	// 只记录这些 token 名称的请求，为空时记录全部
+	Tokens []string `toml:"tokens"`
+	// 写入前把匹配的内容替换为 redact_replacement
+	RedactPatterns    []string `toml:"redact_patterns"`
+	RedactReplacement string   `toml:"redact_replacement"`
+}
+
+func defaultAuditConfig() AuditConfig {
+	return AuditConfig{
+		Sink:              "file",
+		Path:              "audit.jsonl",
+		MaxSizeMB:         100,
+		MaxBackups:        10,
+		RedactReplacement: "[REDACTED]",
+	}
+}
+
+func validateAuditConfig(config AuditConfig) []ConfigProblem {
+	var problems []ConfigProblem
+	if !config.Enabled {
+		return nil
+	}
+
+	switch config.Sink {
+	case "stdout":
+	case "file":
+		if config.Path == "" {
+			problems = append(problems, ConfigProblem{Key: "audit.path", Message: "path is required for the file sink"})
+		}
+	default:
+		problems = append(problems, ConfigProblem{Key: "audit.sink", Message: fmt.Sprintf("unknown sink %q, use stdout or file", config.Sink)})
+	}
+
+	for _, pattern := range config.RedactPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			problems = append(problems, ConfigProblem{Key: "audit.redact_patterns", Message: fmt.Sprintf("invalid pattern %q: %v", pattern, err)})
+		}
+	}
+	return problems
+}
+
+// auditRecord is one line of the audit log.
+type auditRecord struct {
+	Time           time.Time     `json:"time"`
+	RequestID      string        `json:"request_id"`
+	TokenName      string        `json:"token_name"`
+	ConversationID string        `json:"conversation_id"`
+	Model          string        `json:"model"`
+	UpstreamModel  string        `json:"upstream_model"`
+	Stream         bool          `json:"stream"`
+	Messages       []ChatMessage `json:"messages"`
+	Response       string        `json:"response"`
+	Error          string        `json:"error,omitempty"`
+}
+
+// auditLog writes audit records to the configured sink. The sink is
+// reopened when a config reload changes it.
+type auditLog struct {
+	mu       sync.Mutex
+	config   AuditConfig
+	writer   io.WriteCloser
+	patterns []*regexp.Regexp
+}
+
+// 全局审计日志
+var auditor = &auditLog{}
+
+// record writes an audit record if auditing is enabled for the request's
+// token. Failures are logged and never fail the request.
+func (a *auditLog) record(config *Config, info *requestInfo, record auditRecord) {
+	if !config.Audit.Enabled {
+		return
+	}
+	if len(config.Audit.Tokens) > 0 && !slices.Contains(config.Audit.Tokens, info.getTokenName()) {
+		return
+	}
+
+	record.Time = time.Now()
+	record.RequestID = info.id
+	record.TokenName = info.getTokenName()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.configure(config.Audit); err != nil {
+		info.logger().Error("failed to open audit log", zap.Error(err))
+		return
+	}
+
+	record.Messages = slices.Clone(record.Messages)
+	for i := range record.Messages {
+		record.Messages[i].Content = a.redact(record.Messages[i].Content)
+	}
+	record.Response = a.redact(record.Response)
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		info.logger().Error("failed to marshal audit record", zap.Error(err))
+		return
+	}
+	if _, err := a.writer.Write(append(line, '\n')); err != nil {
+		info.logger().Error("failed to write audit record", zap.Error(err))
+	}
+}
+
+func (a *auditLog) configure(config AuditConfig) error {
+	if a.writer != nil && reflect.DeepEqual(a.config, config) {
+		return nil
+	}
+
+	patterns := make([]*regexp.Regexp, 0, len(config.RedactPatterns))
+	for _, pattern := range config.RedactPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		patterns = append(patterns, re)
+	}
+
+	if a.writer != nil {
+		a.writer.Close()
+	}
+
+	if config.Sink == "stdout" {
+		a.writer = nopCloser{os.Stdout}
+	} else {
+		a.writer = &lumberjack.Logger{
+			Filename:   config.Path,
+			MaxSize:    config.MaxSizeMB,
+			MaxBackups: config.MaxBackups,
+			MaxAge:     config.MaxAgeDays,
+			Compress:   config.Compress,
+		}
+	}
+	a.config = config
+	a.patterns = patterns
+	return nil
+}
+
+func (a *auditLog) redact(text string) string {
+	for _, re := range a.patterns {
+		text = re.ReplaceAllString(text, a.config.RedactReplacement)
+	}
+	return text
+}
+
+// close flushes and closes the sink, used on shutdown.
+func (a *auditLog) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.writer != nil {
+		a.writer.Close()
+		a.writer = nil
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,450 @@
+package ddgchat
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+type CacheConfig struct {
+	Enabled bool `toml:"enabled"`
+	// "memory" 或 "disk"
+	Backend    string        `toml:"backend"`
+	TTL        time.Duration `toml:"ttl"`
+	MaxEntries int           `toml:"max_entries"`
+	MaxBytes   int64         `toml:"max_bytes"`
+	// backend 为 disk 时的缓存目录
+	Dir string `toml:"dir"`
+}
+
+func defaultCacheConfig() CacheConfig {
+	return CacheConfig{
+		Backend:    "memory",
+		TTL:        time.Hour,
+		MaxEntries: 1000,
+		MaxBytes:   64 << 20,
+		Dir:        "cache",
+	}
+}
+
+func validateCacheConfig(config CacheConfig) []ConfigProblem {
+	var problems []ConfigProblem
+	if !config.Enabled {
+		return nil
+	}
+
+	switch config.Backend {
+	case "memory":
+	case "disk":
+		if config.Dir == "" {
+			problems = append(problems, ConfigProblem{Key: "cache.dir", Message: "dir is required for the disk backend"})
+		}
+	default:
+		problems = append(problems, ConfigProblem{Key: "cache.backend", Message: fmt.Sprintf("unknown backend %q, use memory or disk", config.Backend)})
+	}
+	if config.TTL <= 0 {
+		problems = append(problems, ConfigProblem{Key: "cache.ttl", Message: fmt.Sprintf("invalid ttl: %s", config.TTL)})
+	}
+	if config.MaxEntries < 1 {
+		problems = append(problems, ConfigProblem{Key: "cache.max_entries", Message: "must be at least 1"})
+	}
+	if config.MaxBytes < 1 {
+		problems = append(problems, ConfigProblem{Key: "cache.max_bytes", Message: "must be at least 1"})
+	}
+	return problems
+}
+
+// cacheEntry is a finished completion stored in the response cache.
+type cacheEntry struct {
+	Response         string    `json:"response"`
+	Model            string    `json:"model,omitempty"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	ExpiresAt        time.Time `json:"expires_at"`
+}
+
+func (e *cacheEntry) size() int64 {
+	return int64(len(e.Response))
+}
+
+type responseCache interface {
+	get(key string) (*cacheEntry, bool)
+	set(key string, entry *cacheEntry)
+}
+
+// completionCacheKey hashes everything that can change the reply: the
+// upstream model and its fallbacks, the messages and the sampling
+// parameters.
+func completionCacheKey(config *Config, req ChatCompletionRequest) string {
+	messages := make([]ChatMessage, len(req.Messages))
+	for i, msg := range req.Messages {
+		messages[i] = ChatMessage{
+			Role:    strings.ToLower(strings.TrimSpace(msg.Role)),
+			Content: strings.TrimSpace(msg.Content),
+		}
+	}
+
+	var fallbacks []string
+	for _, fallback := range config.ModelMapping[req.Model].Fallbacks {
+		fallbacks = append(fallbacks, upstreamModel(config, fallback))
+	}
+
+	normalized := struct {
+		Model           string             `json:"model"`
+		Fallbacks       []string           `json:"fallbacks,omitempty"`
+		Messages        []ChatMessage      `json:"messages"`
+		Temperature     *float64           `json:"temperature"`
+		TopP            *float64           `json:"top_p"`
+		N               *int               `json:"n"`
+		Stop            interface{}        `json:"stop"`
+		MaxTokens       *int               `json:"max_tokens"`
+		PresencePenalty *float64           `json:"presence_penalty"`
+		FreqPenalty     *float64           `json:"frequency_penalty"`
+		LogitBias       map[string]float64 `json:"logit_bias"`
+	}{
+		Model:           upstreamModel(config, req.Model),
+		Fallbacks:       fallbacks,
+		Messages:        messages,
+		Temperature:     req.Temperature,
+		TopP:            req.TopP,
+		N:               req.N,
+		Stop:            req.Stop,
+		MaxTokens:       req.MaxTokens,
+		PresencePenalty: req.PresencePenalty,
+		FreqPenalty:     req.FreqPenalty,
+		LogitBias:       req.LogitBias,
+	}
+
+	data, _ := json.Marshal(normalized)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// cacheHolder keeps the cache backend for the current config, and replaces
+// it when a reload changes the cache settings.
+type cacheHolder struct {
+	mu     sync.Mutex
+	config CacheConfig
+	cache  responseCache
+}
+
+// 全局响应缓存
+var responseCaches = &cacheHolder{}
+
+// get returns the cache for config, or nil if caching is disabled.
+func (h *cacheHolder) get(config *Config) responseCache {
+	if !config.Cache.Enabled {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.cache != nil && reflect.DeepEqual(h.config, config.Cache) {
+		return h.cache
+	}
+
+	if config.Cache.Backend == "disk" {
+		h.cache = newDiskCache(config.Cache)
+	} else {
+		h.cache = newMemoryCache(config.Cache)
+	}
+	h.config = config.Cache
+	return h.cache
+}
+
+// storeCompletion saves a finished completion under the request's cache key.
+func storeCompletion(config *Config, info *requestInfo, response string, promptTokens int, completionTokens int) {
+	if info.cacheKey == "" {
+		return
+	}
+	cache := responseCaches.get(config)
+	if cache == nil {
+		return
+	}
+	cache.set(info.cacheKey, &cacheEntry{
+		Response:         response,
+		Model:            info.getModelUsed(""),
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		ExpiresAt:        time.Now().Add(config.Cache.TTL),
+	})
+}
+
+// memoryCache is an in-memory LRU limited by entry count and total size.
+type memoryCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	order      *list.List
+	items      map[string]*list.Element
+}
+
+type memoryCacheItem struct {
+	key   string
+	entry *cacheEntry
+}
+
+func newMemoryCache(config CacheConfig) *memoryCache {
+	return &memoryCache{
+		maxEntries: config.MaxEntries,
+		maxBytes:   config.MaxBytes,
+		order:      list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+func (m *memoryCache) get(key string) (*cacheEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	elem, ok := m.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := elem.Value.(*memoryCacheItem)
+	if time.Now().After(item.entry.ExpiresAt) {
+		m.remove(elem)
+		return nil, false
+	}
+	m.order.MoveToFront(elem)
+	return item.entry, true
+}
+
+func (m *memoryCache) set(key string, entry *cacheEntry) {
+	if entry.size() > m.maxBytes {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if elem, ok := m.items[key]; ok {
+		m.remove(elem)
+	}
+	m.items[key] = m.order.PushFront(&memoryCacheItem{key: key, entry: entry})
+	m.bytes += entry.size()
+
+	for m.order.Len() > m.maxEntries || m.bytes > m.maxBytes {
+		m.remove(m.order.Back())
+	}
+}
+
+func (m *memoryCache) remove(elem *list.Element) {
+	item := m.order.Remove(elem).(*memoryCacheItem)
+	delete(m.items, item.key)
+	m.bytes -= item.entry.size()
+}
+
+// diskCache stores one JSON file per entry. File modification times track
+// recent use, the least recently used files are removed first.
+type diskCache struct {
+	mu         sync.Mutex
+	dir        string
+	maxEntries int
+	maxBytes   int64
+}
+
+func newDiskCache(config CacheConfig) *diskCache {
+	return &diskCache{
+		dir:        config.Dir,
+		maxEntries: config.MaxEntries,
+		maxBytes:   config.MaxBytes,
+	}
+}
+
+func (d *diskCache) path(key string) string {
+	return filepath.Join(d.dir, key+".json")
+}
+
+func (d *diskCache) get(key string) (*cacheEntry, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	data, err := os.ReadFile(d.path(key))
+	if err != nil {
+		return nil, false
+	}
+
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || time.Now().After(entry.ExpiresAt) {
+		os.Remove(d.path(key))
+		return nil, false
+	}
+
+	now := time.Now()
+	os.Chtimes(d.path(key), now, now)
+	return &entry, true
+}
+
+func (d *diskCache) set(key string, entry *cacheEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := os.MkdirAll(d.dir, 0o755); err != nil {
+		logger.Error("failed to create cache dir", zap.String("dir", d.dir), zap.Error(err))
+		return
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	// 先写临时文件再重命名，避免读到写了一半的文件
+	tmp, err := os.CreateTemp(d.dir, key+".*.tmp")
+	if err != nil {
+		logger.Error("failed to write cache entry", zap.Error(err))
+		return
+	}
+	_, err = tmp.Write(data)
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), d.path(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		logger.Error("failed to write cache entry", zap.Error(err))
+		return
+	}
+
+	d.evict()
+}
+
+func (d *diskCache) evict() {
+	files, err := filepath.Glob(filepath.Join(d.dir, "*.json"))
+	if err != nil {
+		return
+	}
+
+	type cacheFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var entries []cacheFile
+	var total int64
+	for _, file := range files {
+		stat, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, cacheFile{path: file, size: stat.Size(), modTime: stat.ModTime()})
+		total += stat.Size()
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.Before(entries[j].modTime)
+	})
+	for len(entries) > d.maxEntries || total > d.maxBytes {
+		os.Remove(entries[0].path)
+		total -= entries[0].size
+		entries = entries[1:]
+	}
+}
+
+// cacheDirectives reports whether the request asked to skip the cache
+// lookup (no-cache) or to not store the reply (no-store).
+func cacheDirectives(c *fiber.Ctx) (noCache bool, noStore bool) {
+	for _, directive := range strings.Split(c.Get(fiber.HeaderCacheControl), ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "no-cache":
+			noCache = true
+		case "no-store":
+			noCache = true
+			noStore = true
+		}
+	}
+	return noCache, noStore
+}
+
+// sendCachedCompletion answers from a cache entry, as a JSON completion or,
+// for stream requests, replayed as SSE chunks.
+func sendCachedCompletion(c *fiber.Ctx, req ChatCompletionRequest, conversationId string, entry *cacheEntry, config *Config) error {
+	info := requestInfoFromContext(c.UserContext())
+	if entry.Model != "" {
+		info.setModelUsed(entry.Model)
+	}
+	model := info.getModelUsed(req.Model)
+	c.Set("X-Model-Used", model)
+	info.promptTokens.Store(int64(entry.PromptTokens))
+	info.completionTokens.Store(int64(entry.CompletionTokens))
+	auditor.record(config, info, auditRecord{
+		ConversationID: conversationId,
+		Model:          req.Model,
+		UpstreamModel:  upstreamModel(config, model),
+		Stream:         req.Stream,
+		Messages:       req.Messages,
+		Response:       entry.Response,
+	})
+
+	// 与正常请求一样记录对话历史
+	saveConversation(c.UserContext(), conversationId, append(slices.Clone(req.Messages), ChatMessage{
+		Role:    "assistant",
+		Content: entry.Response,
+	}))
+	conversationSummaries.maybeSummarize(c.UserContext(), config, conversationId)
+
+	stop := "stop"
+	created := time.Now().Unix()
+	if !req.Stream {
+		return c.JSON(&ChatCompletionResponse{
+			ID:      conversationId,
+			Object:  "chat.completion",
+			Created: created,
+			Model:   model,
+			Choices: []ChatCompletionResponseChoice{
+				{
+					Index:        0,
+					Message:      ChatMessage{Role: "assistant", Content: entry.Response},
+					FinishReason: &stop,
+				},
+			},
+			Usage: ChatCompletionResponseUsage{
+				PromptTokens:     entry.PromptTokens,
+				CompletionTokens: entry.CompletionTokens,
+				TotalTokens:      entry.PromptTokens + entry.CompletionTokens,
+			},
+		})
+	}
+
+	// 按词切分后一次性写出，不需要模拟延迟
+	var body strings.Builder
+	writeChunk := func(delta DeltaMessage, finishReason *string) {
+		responseJSON, _ := json.Marshal(ChatCompletionStreamResponse{
+			ID:      conversationId,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   model,
+			Choices: []ChatCompletionStreamResponseChoice{
+				{Index: 0, Delta: delta, FinishReason: finishReason},
+			},
+		})
+		fmt.Fprintf(&body, "data: %s\n\n", responseJSON)
+	}
+	for _, word := range strings.SplitAfter(entry.Response, " ") {
+		if word == "" {
+			continue
+		}
+		writeChunk(DeltaMessage{Content: &word}, nil)
+	}
+	writeChunk(DeltaMessage{}, &stop)
+	body.WriteString("data: [DONE]\n\n")
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	return c.SendString(body.String())
+}
@@ -0,0 +1,141 @@
+package ddgchat
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+type UpstreamClientConfig struct {
+	// 每个上游地址的最大连接数
+	MaxConnsPerHost int `toml:"max_conns_per_host"`
+	// 连接数达到上限时等待空闲连接的最长时间，聊天回复会占用连接直到读完
+	MaxConnWaitTimeout time.Duration `toml:"max_conn_wait_timeout"`
+	// 空闲连接保留多久，0 使用 fasthttp 的默认值
+	MaxIdleConnDuration time.Duration `toml:"max_idle_conn_duration"`
+	// 连接最长使用多久后重建，0 表示不限制
+	MaxConnDuration time.Duration `toml:"max_conn_duration"`
+	DialTimeout     time.Duration `toml:"dial_timeout"`
+	// 读取完整响应（包括整个聊天流）的最长时间
+	ReadTimeout  time.Duration `toml:"read_timeout"`
+	WriteTimeout time.Duration `toml:"write_timeout"`
+	// "1.2" 或 "1.3"
+	TLSMinVersion      string `toml:"tls_min_version"`
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify"`
+	// PEM 格式的 CA 证书文件，为空时使用系统证书
+	CABundle string `toml:"ca_bundle"`
+}
+
+func defaultUpstreamClientConfig() UpstreamClientConfig {
+	return UpstreamClientConfig{
+		MaxConnsPerHost:     64,
+		MaxConnWaitTimeout:  30 * time.Second,
+		MaxIdleConnDuration: 90 * time.Second,
+		DialTimeout:         10 * time.Second,
+		ReadTimeout:         2 * time.Minute,
+		WriteTimeout:        10 * time.Second,
+		TLSMinVersion:       "1.2",
+	}
+}
+
+func validateUpstreamClientConfig(config UpstreamClientConfig) []ConfigProblem {
+	var problems []ConfigProblem
+
+	if config.MaxConnsPerHost < 1 {
+		problems = append(problems, ConfigProblem{Key: "upstream_client.max_conns_per_host", Message: "must be at least 1"})
+	}
+	// 为 0 时 fasthttp 不等待，连接用完后的请求会立即失败
+	if config.MaxConnWaitTimeout <= 0 {
+		problems = append(problems, ConfigProblem{Key: "upstream_client.max_conn_wait_timeout", Message: fmt.Sprintf("must be positive: %s", config.MaxConnWaitTimeout)})
+	}
+	durations := []struct {
+		key   string
+		value time.Duration
+	}{
+		{"max_idle_conn_duration", config.MaxIdleConnDuration},
+		{"max_conn_duration", config.MaxConnDuration},
+		{"dial_timeout", config.DialTimeout},
+		{"read_timeout", config.ReadTimeout},
+		{"write_timeout", config.WriteTimeout},
+	}
+	for _, duration := range durations {
+		if duration.value < 0 {
+			problems = append(problems, ConfigProblem{Key: "upstream_client." + duration.key, Message: fmt.Sprintf("must not be negative: %s", duration.value)})
+		}
+	}
+	if _, err := tlsVersion(config.TLSMinVersion); err != nil {
+		problems = append(problems, ConfigProblem{Key: "upstream_client.tls_min_version", Message: err.Error()})
+	}
+	if config.CABundle != "" {
+		if _, err := loadCABundle(config.CABundle); err != nil {
+			problems = append(problems, ConfigProblem{Key: "upstream_client.ca_bundle", Message: err.Error()})
+		}
+	}
+	return problems
+}
+
+func tlsVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version %q, use 1.2 or 1.3", version)
+}
+
+func loadCABundle(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", path)
+	}
+	return pool, nil
+}
+
+// newUpstreamClient builds the long-lived client for one egress. dial is
+// nil for direct connections.
+func newUpstreamClient(config UpstreamClientConfig, dial fasthttp.DialFunc) (*fasthttp.Client, error) {
+	minVersion, err := tlsVersion(config.TLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:         minVersion,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if config.CABundle != "" {
+		if tlsConfig.RootCAs, err = loadCABundle(config.CABundle); err != nil {
+			return nil, err
+		}
+	}
+
+	if dial == nil {
+		dialTimeout := config.DialTimeout
+		dial = func(addr string) (net.Conn, error) {
+			if dialTimeout > 0 {
+				return fasthttp.DialTimeout(addr, dialTimeout)
+			}
+			return fasthttp.Dial(addr)
+		}
+	}
+
+	return &fasthttp.Client{
+		Dial:                dial,
+		TLSConfig:           tlsConfig,
+		MaxConnsPerHost:     config.MaxConnsPerHost,
+		MaxConnWaitTimeout:  config.MaxConnWaitTimeout,
+		MaxIdleConnDuration: config.MaxIdleConnDuration,
+		MaxConnDuration:     config.MaxConnDuration,
+		ReadTimeout:         config.ReadTimeout,
+		WriteTimeout:        config.WriteTimeout,
+	}, nil
+}
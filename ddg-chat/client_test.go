@@ -0,0 +1,181 @@
+package ddgchat
+
+import (
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// newTLSUpstream starts a local HTTPS stub answering like the chat endpoint
+// and returns its URL and a client config trusting its certificate, so the
+// benchmarks include the TLS handshakes a real upstream costs.
+func newTLSUpstream(b *testing.B) (string, UpstreamClientConfig) {
+	b.Helper()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeChatEvents(w, "hello", " world")
+	}))
+	b.Cleanup(server.Close)
+
+	caBundle := filepath.Join(b.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caBundle, cert, 0o600); err != nil {
+		b.Fatal(err)
+	}
+
+	config := defaultUpstreamClientConfig()
+	config.CABundle = caBundle
+	return server.URL + "/duckchat/v1/chat", config
+}
+
+func newBenchClient(b *testing.B, config UpstreamClientConfig) *fasthttp.Client {
+	b.Helper()
+	client, err := newUpstreamClient(config, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(client.CloseIdleConnections)
+	return client
+}
+
+// benchmarkRequests sends b.N chat requests from parallel goroutines.
+// client returns the client for each request, connectionClose disables
+// keep-alive the way every request did before the shared client.
+func benchmarkRequests(b *testing.B, uri string, client func() *fasthttp.Client, connectionClose bool) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		req := fasthttp.AcquireRequest()
+		defer fasthttp.ReleaseRequest(req)
+		resp := fasthttp.AcquireResponse()
+		defer fasthttp.ReleaseResponse(resp)
+
+		for pb.Next() {
+			req.Reset()
+			req.SetRequestURI(uri)
+			req.Header.SetMethod(fasthttp.MethodPost)
+			req.SetBodyString(`{"model":"gpt-4o-mini","messages":[{"role":"user","content":"hi"}]}`)
+			if connectionClose {
+				req.SetConnectionClose()
+			}
+			if err := client().Do(req, resp); err != nil {
+				b.Fatal(err)
+			}
+			if resp.StatusCode() != fasthttp.StatusOK {
+				b.Fatalf("status %d", resp.StatusCode())
+			}
+		}
+	})
+}
+
+// BenchmarkUpstreamClientPooled uses the shared client built from the
+// default [upstream_client] settings.
+func BenchmarkUpstreamClientPooled(b *testing.B) {
+	uri, config := newTLSUpstream(b)
+	client := newBenchClient(b, config)
+	benchmarkRequests(b, uri, func() *fasthttp.Client { return client }, false)
+}
+
+// BenchmarkUpstreamClientDefault uses a shared fasthttp client with its
+// default settings.
+func BenchmarkUpstreamClientDefault(b *testing.B) {
+	uri, config := newTLSUpstream(b)
+	tlsClient := newBenchClient(b, config)
+	client := &fasthttp.Client{TLSConfig: tlsClient.TLSConfig}
+	b.Cleanup(client.CloseIdleConnections)
+	benchmarkRequests(b, uri, func() *fasthttp.Client { return client }, false)
+}
+
+// BenchmarkUpstreamClientPerRequest builds a new client and closes the
+// connection for every request, the behaviour before the shared client.
+func BenchmarkUpstreamClientPerRequest(b *testing.B) {
+	uri, config := newTLSUpstream(b)
+	tlsConfig := newBenchClient(b, config).TLSConfig
+	benchmarkRequests(b, uri, func() *fasthttp.Client {
+		return &fasthttp.Client{TLSConfig: tlsConfig}
+	}, true)
+}
+
+// BenchmarkUpstreamClientKeepAlive compares keep-alive settings of the
+// shared client.
+func BenchmarkUpstreamClientKeepAlive(b *testing.B) {
+	uri, config := newTLSUpstream(b)
+	settings := []struct {
+		name   string
+		change func(*UpstreamClientConfig)
+	}{
+		{name: "default", change: func(*UpstreamClientConfig) {}},
+		{name: "max_conn_duration=5ms", change: func(c *UpstreamClientConfig) { c.MaxConnDuration = 5 * time.Millisecond }},
+		{name: "max_idle_conn_duration=1ms", change: func(c *UpstreamClientConfig) { c.MaxIdleConnDuration = time.Millisecond }},
+		{name: "max_conns_per_host=1", change: func(c *UpstreamClientConfig) { c.MaxConnsPerHost = 1 }},
+		{name: "max_conns_per_host=4", change: func(c *UpstreamClientConfig) { c.MaxConnsPerHost = 4 }},
+	}
+	for _, setting := range settings {
+		b.Run(setting.name, func(b *testing.B) {
+			tuned := config
+			setting.change(&tuned)
+			client := newBenchClient(b, tuned)
+			benchmarkRequests(b, uri, func() *fasthttp.Client { return client }, false)
+		})
+	}
+}
+
+// TestUpstreamClientWaitsForConnection holds every connection with a slow
+// reply and checks that further requests wait instead of failing with
+// ErrNoFreeConns.
+func TestUpstreamClientWaitsForConnection(t *testing.T) {
+	server := newStubUpstream(t, map[string]http.HandlerFunc{
+		"/duckchat/v1/chat": func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(50 * time.Millisecond)
+			writeChatEvents(w, "ok")
+		},
+	})
+	config := defaultUpstreamClientConfig()
+	config.MaxConnsPerHost = 1
+	client, err := newUpstreamClient(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.CloseIdleConnections()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := fasthttp.AcquireRequest()
+			defer fasthttp.ReleaseRequest(req)
+			resp := fasthttp.AcquireResponse()
+			defer fasthttp.ReleaseResponse(resp)
+			req.SetRequestURI(server.URL + "/duckchat/v1/chat")
+			errs <- client.Do(req, resp)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if errors.Is(err, fasthttp.ErrNoFreeConns) {
+			t.Fatal("request failed instead of waiting for a free connection")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestValidateMaxConnWaitTimeout(t *testing.T) {
+	config := defaultUpstreamClientConfig()
+	config.MaxConnWaitTimeout = 0
+	problems := validateUpstreamClientConfig(config)
+	if len(problems) != 1 || problems[0].Key != "upstream_client.max_conn_wait_timeout" {
+		t.Errorf("problems = %+v, want one for max_conn_wait_timeout", problems)
+	}
+}
@@ -0,0 +1,220 @@
+package ddgchat
+
+import (
+	"context"
+	"sync"
+)
+
+// flight is one upstream chat shared by identical concurrent requests. All
+// chunks are kept so that subscribers joining late replay the whole reply.
+type flight struct {
+	mu     sync.Mutex
+	chunks []string
+	// 当前尝试的模型，订阅者用它报告实际回答的模型
+	model       string
+	done        bool
+	err         error
+	subscribers int
+	// 上游请求排队时的位置，positions 是报告的次数，每次报告都转发给订阅者
+	position  int
+	positions int
+	// 每收到一个 chunk 关闭并替换，用来唤醒等待的订阅者
+	notify chan struct{}
+	cancel context.CancelFunc
+}
+
+func (f *flight) append(chunk string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.chunks = append(f.chunks, chunk)
+	close(f.notify)
+	f.notify = make(chan struct{})
+}
+
+func (f *flight) setModel(model string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.model = model
+}
+
+func (f *flight) setPosition(position int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.position = position
+	f.positions++
+	close(f.notify)
+	f.notify = make(chan struct{})
+}
+
+func (f *flight) finish(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.done = true
+	f.err = err
+	close(f.notify)
+}
+
+// flightGroup coalesces identical concurrent chat requests of the same
+// token, keyed like the response cache.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// 全局进行中的上游请求
+var inflightChats = &flightGroup{flights: make(map[string]*flight)}
+
+// coalescedChat behaves like chatWithFallbacks, but identical requests of
+// the same token running at the same time share one upstream call. The upstream call is
+// cancelled only when every subscriber has gone. The model that answered
+// is recorded in the request info of ctx.
+//
+// Every upstream call waits for a slot of the request queue first, a shared
+// call takes one slot for all its subscribers. onPosition is called with the
+// queue position while it waits, see requestQueue.acquire.
+func coalescedChat(ctx context.Context, req ChatCompletionRequest, query string, history []ChatMessage, channel chan string, config *Config, onPosition func(position int)) error {
+	info := requestInfoFromContext(ctx)
+	if !config.CoalesceRequests {
+		release, err := upstreamQueue.acquire(ctx, config.Queue, info.getTokenName(), onPosition)
+		if err != nil {
+			return err
+		}
+		defer release()
+		return chatWithFallbacks(ctx, query, req.Model, history, channel, config, info.setModelUsed)
+	}
+
+	// 上游请求使用第一个请求的 token 做脱敏、内容策略和审计，只合并同一个 token 的请求
+	key := info.getTokenName() + "\x00" + completionCacheKey(config, req)
+	f, flightCtx := inflightChats.join(ctx, key)
+	if flightCtx != nil {
+		go inflightChats.run(flightCtx, key, f, query, req.Model, history, config)
+	} else {
+		coalescedRequests.Inc()
+		loggerFromContext(ctx).Debug("joined in-flight upstream request")
+	}
+
+	return inflightChats.subscribe(ctx, key, f, channel, onPosition)
+}
+
+// join subscribes to the flight for key. If there is none it is created
+// and the context for the upstream call is returned, the caller must start
+// it with run.
+func (g *flightGroup) join(ctx context.Context, key string) (*flight, context.Context) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if f, ok := g.flights[key]; ok {
+		f.mu.Lock()
+		f.subscribers++
+		f.mu.Unlock()
+		return f, nil
+	}
+
+	// 上游请求沿用第一个请求的日志和 trace，但不随它一起取消
+	flightCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	f := &flight{subscribers: 1, notify: make(chan struct{}), cancel: cancel}
+	g.flights[key] = f
+	return f, flightCtx
+}
+
+func (g *flightGroup) run(ctx context.Context, key string, f *flight, query string, model string, history []ChatMessage, config *Config) {
+	defer f.cancel()
+
+	// 排队位置通过 flight 转发给所有订阅者
+	release, err := upstreamQueue.acquire(ctx, config.Queue, requestInfoFromContext(ctx).getTokenName(), f.setPosition)
+	if err != nil {
+		g.remove(key, f)
+		f.finish(err)
+		return
+	}
+	defer release()
+
+	chunks := make(chan string)
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		for chunk := range chunks {
+			f.append(chunk)
+		}
+	}()
+
+	err = chatWithFallbacks(ctx, query, model, history, chunks, config, f.setModel)
+	close(chunks)
+	<-forwarded
+
+	// 先从 map 中移除，之后到达的相同请求会重新请求上游（或命中缓存）
+	g.remove(key, f)
+	f.finish(err)
+}
+
+// subscribe sends every chunk of f to channel, from the first one, until
+// the flight finishes or ctx is done. Queue positions of the flight are
+// passed to onPosition.
+func (g *flightGroup) subscribe(ctx context.Context, key string, f *flight, channel chan string, onPosition func(position int)) error {
+	info := requestInfoFromContext(ctx)
+	sent := 0
+	reported := 0
+	for {
+		f.mu.Lock()
+		pending := f.chunks[sent:]
+		model, done, err, notify := f.model, f.done, f.err, f.notify
+		position, positions := f.position, f.positions
+		f.mu.Unlock()
+
+		if model != "" {
+			info.setModelUsed(model)
+		}
+		// 中途加入的订阅者只收到最新的位置
+		if positions > reported {
+			reported = positions
+			onPosition(position)
+		}
+
+		for _, chunk := range pending {
+			select {
+			case channel <- chunk:
+			case <-ctx.Done():
+				g.leave(key, f)
+				return ctx.Err()
+			}
+		}
+		sent += len(pending)
+
+		if done {
+			return err
+		}
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			g.leave(key, f)
+			return ctx.Err()
+		}
+	}
+}
+
+// leave drops a subscriber and cancels the upstream call if it was the
+// last one.
+func (g *flightGroup) leave(key string, f *flight) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.subscribers--
+	if f.subscribers > 0 || f.done {
+		return
+	}
+	if g.flights[key] == f {
+		delete(g.flights, key)
+	}
+	f.cancel()
+}
+
+func (g *flightGroup) remove(key string, f *flight) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.flights[key] == f {
+		delete(g.flights, key)
+	}
+}
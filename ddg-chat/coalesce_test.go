@@ -0,0 +1,73 @@
+package ddgchat
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCoalescedChatTakesOneQueueSlot(t *testing.T) {
+	defer func(queue *requestQueue) { upstreamQueue = queue }(upstreamQueue)
+	upstreamQueue = &requestQueue{}
+
+	config := stubConfig(newStubUpstream(t, nil))
+	config.CoalesceRequests = true
+	config.Queue = QueueConfig{Enabled: true, MaxConcurrency: 1, MaxQueue: 1, Timeout: 10 * time.Second, PositionInterval: time.Hour}
+
+	// 占住唯一的名额，合并的请求只能排一个队
+	release, err := upstreamQueue.acquire(context.Background(), config.Queue, "", func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const subscribers = 3
+	req := ChatCompletionRequest{Model: "ddg/gpt-4o-mini", Messages: []ChatMessage{{Role: "user", Content: "hi"}}}
+	positions := make(chan int, subscribers)
+	replies := make([]string, subscribers)
+	errs := make([]error, subscribers)
+	var wg sync.WaitGroup
+	for i := range subscribers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			channel := make(chan string)
+			collected := make(chan string)
+			go func() {
+				var reply strings.Builder
+				for chunk := range channel {
+					reply.WriteString(chunk)
+				}
+				collected <- reply.String()
+			}()
+			errs[i] = coalescedChat(context.Background(), req, "hi", req.Messages, channel, config, func(position int) {
+				positions <- position
+			})
+			close(channel)
+			replies[i] = <-collected
+		}()
+	}
+
+	// 每个订阅者都收到首个请求的排队位置
+	for range subscribers {
+		select {
+		case position := <-positions:
+			if position != 1 {
+				t.Errorf("queue position %d, want 1", position)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("subscribers were not told their queue position")
+		}
+	}
+	release()
+	wg.Wait()
+
+	for i := range subscribers {
+		if errs[i] != nil {
+			t.Errorf("subscriber %d: %v", i, errs[i])
+		} else if replies[i] != "hello world" {
+			t.Errorf("subscriber %d got %q", i, replies[i])
+		}
+	}
+}
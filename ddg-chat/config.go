@@ -1,34 +1,153 @@
 package ddgchat
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"go.uber.org/zap"
 )
 
 type Config struct {
-	Port          int               `toml:"port"`
-	Host          string            `toml:"host"`
-	UserAgent     string            `toml:"user_agent"`
-	Tokens        []string          `toml:"tokens"`
-	DDGChatAPIURL string            `toml:"ddg_chat_api_url"`
-	ModelMapping  map[string]string `toml:"model_mapping"`
+	Port      int      `toml:"port"`
+	Host      string   `toml:"host"`
+	UserAgent string   `toml:"user_agent"`
+	Tokens    []string `toml:"tokens" secret:"true"`
+	// 名称 -> token，用于日志和监控中区分调用方，这些 token 同样可以通过认证
+	TokenNames    map[string]string     `toml:"token_names" secret:"true"`
+	DDGChatAPIURL string                `toml:"ddg_chat_api_url" env:"DDG_CHAT_API_URL"`
+	ModelMapping  map[string]ModelEntry `toml:"model_mapping"`
+	// 关闭时等待进行中请求完成的最长时间
+	ShutdownTimeout time.Duration `toml:"shutdown_timeout"`
+	// 相同的并发请求共用一次上游请求
+	CoalesceRequests bool `toml:"coalesce_requests"`
+	// 上游健康检查，决定 /ready 和 /health 的结果
+	Health HealthConfig `toml:"health"`
+	// Prometheus 指标
+	Metrics MetricsConfig `toml:"metrics"`
+	// OpenTelemetry 链路追踪
+	Tracing TracingConfig `toml:"tracing"`
+	// 请求和回复的审计日志
+	Audit AuditConfig `toml:"audit"`
+	// 相同请求的回复缓存
+	Cache CacheConfig `toml:"cache"`
+	// 上游并发限制和优先级队列
+	Queue QueueConfig `toml:"queue"`
+	// 访问 DuckDuckGo 的出口代理池
+	ProxyPool ProxyPoolConfig `toml:"proxy_pool"`
+	// 访问 DuckDuckGo 的 HTTP client 设置
+	UpstreamClient UpstreamClientConfig `toml:"upstream_client"`
+	// 发给 DuckDuckGo 的浏览器请求头，user_agent 不为空时不使用
+	Fingerprint FingerprintConfig `toml:"fingerprint"`
+	// 请求中的模型名如何对应到 model_mapping
+	ModelRouting ModelRoutingConfig `toml:"model_routing"`
+	// 从上游获取可用的模型列表
+	Discovery DiscoveryConfig `toml:"discovery"`
+	// 历史超出上下文窗口时如何截断
+	Context ContextConfig `toml:"context"`
+	// 服务端保存的对话过长时总结较早的消息
+	Summarization SummarizationConfig `toml:"summarization"`
+	// 改写或拦截请求和回复的规则
+	Hooks HooksConfig `toml:"hooks"`
+	// 按 token 分组的关键词和正则表达式黑名单
+	ContentPolicy ContentPolicyConfig `toml:"content_policy"`
+	// 发给上游之前替换个人信息
+	Redaction RedactionConfig `toml:"redaction"`
+
+	// 由上面的设置编译出的规则，ConfigStore 发布配置时生成
+	compiled *compiledState
 }
 
-func LoadConfig(configPath string) (*Config, error) {
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		logger.Error("config file does not exist", zap.String("config_path", configPath))
-		return nil, fmt.Errorf("config file does not exist: %s", configPath)
+// 未开启认证时使用的调用方名称
+const anonymousTokenName = "anonymous"
+
+func (config *Config) authEnabled() bool {
+	return len(config.Tokens) > 0 || len(config.TokenNames) > 0
+}
+
+// tokenName returns the name of a valid token. Tokens in token_names use
+// their configured name, tokens only listed in tokens are named by their
+// position, e.g. "token-1".
+func (config *Config) tokenName(token string) (string, bool) {
+	names := make([]string, 0, len(config.TokenNames))
+	for name := range config.TokenNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if config.TokenNames[name] == token {
+			return name, true
+		}
 	}
 
-	config := &Config{}
+	if i := slices.Index(config.Tokens, token); i >= 0 {
+		return fmt.Sprintf("token-%d", i+1), true
+	}
+	return "", false
+}
 
-	if _, err := toml.DecodeFile(configPath, config); err != nil {
-		logger.Error("failed to decode config file", zap.String("config_path", configPath), zap.Error(err))
-		return nil, fmt.Errorf("failed to decode config file: %s", err)
+// DefaultConfig returns the config used when no config file is given.
+func DefaultConfig() *Config {
+	modelMapping := make(map[string]ModelEntry, len(DEFAULT_MODEL_MAPPING))
+	for k, v := range DEFAULT_MODEL_MAPPING {
+		modelMapping[k] = ModelEntry{Model: v}
+	}
+
+	return &Config{
+		Port:          8085,
+		Host:          "0.0.0.0",
+		DDGChatAPIURL: "https://duckduckgo.com",
+		ModelMapping:  modelMapping,
+
+		ShutdownTimeout:  30 * time.Second,
+		CoalesceRequests: true,
+		Health:           defaultHealthConfig(),
+		Metrics:          defaultMetricsConfig(),
+		Tracing:          defaultTracingConfig(),
+		Audit:            defaultAuditConfig(),
+		Cache:            defaultCacheConfig(),
+		Queue:            defaultQueueConfig(),
+		ProxyPool:        defaultProxyPoolConfig(),
+		UpstreamClient:   defaultUpstreamClientConfig(),
+		Fingerprint:      defaultFingerprintConfig(),
+		ModelRouting:     defaultModelRoutingConfig(),
+		Discovery:        defaultDiscoveryConfig(),
+		Context:          defaultContextConfig(),
+		Summarization:    defaultSummarizationConfig(),
+		Hooks:            defaultHooksConfig(),
+		ContentPolicy:    defaultContentPolicyConfig(),
+		Redaction:        defaultRedactionConfig(),
+	}
+}
+
+// LoadConfig builds the effective config: defaults, then the config file
+// (skipped if configPath is empty), then DDG_CHAT_* environment variables,
+// then overrides (usually command line flags), and validates the result.
+func LoadConfig(configPath string, overrides ...func(*Config) error) (*Config, error) {
+	config := DefaultConfig()
+
+	if configPath != "" {
+		if err := readConfigFile(config, configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := ApplyEnvOverrides(config, os.LookupEnv); err != nil {
+		logger.Error("invalid environment override", zap.Error(err))
+		return nil, err
+	}
+
+	for _, override := range overrides {
+		if err := override(config); err != nil {
+			logger.Error("invalid config override", zap.Error(err))
+			return nil, err
+		}
 	}
 
 	if err := ValidateConfig(config); err != nil {
@@ -39,21 +158,121 @@ func LoadConfig(configPath string) (*Config, error) {
 	return config, nil
 }
 
+func readConfigFile(config *Config, configPath string) error {
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		logger.Error("config file does not exist", zap.String("config_path", configPath))
+		return fmt.Errorf("config file does not exist: %s", configPath)
+	}
+
+	// toml 会把表合并进已有的 map，这里先清空，文件里没有定义时再恢复默认值
+	defaultMapping := config.ModelMapping
+	config.ModelMapping = nil
+
+	md, err := toml.DecodeFile(configPath, config)
+	if err != nil {
+		logger.Error("failed to decode config file", zap.String("config_path", configPath), zap.Error(err))
+		return fmt.Errorf("failed to decode config file: %s", err)
+	}
+
+	if !md.IsDefined("model_mapping") {
+		config.ModelMapping = defaultMapping
+	}
+
+	return nil
+}
+
+// ConfigProblem is a single validation failure. Line is only known when the
+// config was checked from a file.
+type ConfigProblem struct {
+	Key     string
+	Line    int
+	Message string
+}
+
+func (p ConfigProblem) String() string {
+	msg := p.Message
+	if p.Key != "" {
+		msg = p.Key + ": " + msg
+	}
+	if p.Line > 0 {
+		msg = fmt.Sprintf("line %d: %s", p.Line, msg)
+	}
+	return msg
+}
+
+// ValidateConfig checks the settings the server cannot start without and
+// returns all problems joined into one error.
 func ValidateConfig(config *Config) error {
+	problems := validateConfig(config)
+	var errs []error
+	for _, problem := range problems {
+		logger.Error("invalid config", zap.String("key", problem.Key), zap.String("problem", problem.Message))
+		errs = append(errs, errors.New(problem.String()))
+	}
+	return errors.Join(errs...)
+}
+
+func validateConfig(config *Config) []ConfigProblem {
+	var problems []ConfigProblem
+
 	if config.Port < 1 || config.Port > 65535 {
-		logger.Error("invalid port", zap.Int("port", config.Port))
-		return fmt.Errorf("invalid port: %d", config.Port)
+		problems = append(problems, ConfigProblem{Key: "port", Message: fmt.Sprintf("invalid port: %d", config.Port)})
 	}
 
 	if matched, _ := regexp.MatchString("^[a-zA-Z0-9.-]+$", config.Host); !matched {
-		logger.Error("invalid host", zap.String("host", config.Host))
-		return fmt.Errorf("invalid host: %s", config.Host)
+		problems = append(problems, ConfigProblem{Key: "host", Message: fmt.Sprintf("invalid host: %s", config.Host)})
+	}
+
+	if config.ShutdownTimeout < 0 {
+		problems = append(problems, ConfigProblem{Key: "shutdown_timeout", Message: fmt.Sprintf("invalid shutdown timeout: %s", config.ShutdownTimeout)})
+	}
+
+	if config.Health.Enabled {
+		if config.Health.Interval <= 0 {
+			problems = append(problems, ConfigProblem{Key: "health.interval", Message: fmt.Sprintf("invalid interval: %s", config.Health.Interval)})
+		}
+		if config.Health.Timeout <= 0 {
+			problems = append(problems, ConfigProblem{Key: "health.timeout", Message: fmt.Sprintf("invalid timeout: %s", config.Health.Timeout)})
+		}
+		if config.Health.FailureThreshold < 1 {
+			problems = append(problems, ConfigProblem{Key: "health.failure_threshold", Message: "must be at least 1"})
+		}
+		if config.Health.SuccessThreshold < 1 {
+			problems = append(problems, ConfigProblem{Key: "health.success_threshold", Message: "must be at least 1"})
+		}
 	}
 
+	if config.Metrics.Enabled && !strings.HasPrefix(config.Metrics.Path, "/") {
+		problems = append(problems, ConfigProblem{Key: "metrics.path", Message: fmt.Sprintf("path must start with /: %s", config.Metrics.Path)})
+	}
+
+	if config.Tracing.Enabled {
+		if config.Tracing.Endpoint == "" {
+			problems = append(problems, ConfigProblem{Key: "tracing.endpoint", Message: "endpoint is required"})
+		}
+		if config.Tracing.SampleRatio < 0 || config.Tracing.SampleRatio > 1 {
+			problems = append(problems, ConfigProblem{Key: "tracing.sample_ratio", Message: fmt.Sprintf("must be between 0 and 1: %g", config.Tracing.SampleRatio)})
+		}
+	}
+
+	problems = append(problems, validateModelMapping(config.ModelMapping)...)
+	problems = append(problems, validateModelRoutingConfig(config.ModelRouting, config.ModelMapping)...)
+	problems = append(problems, validateDiscoveryConfig(config.Discovery)...)
+	problems = append(problems, validateContextConfig(config.Context)...)
+	problems = append(problems, validateSummarizationConfig(config.Summarization, config.ModelMapping)...)
+	problems = append(problems, validateHooksConfig(config.Hooks)...)
+	problems = append(problems, validateContentPolicyConfig(config.ContentPolicy)...)
+	problems = append(problems, validateRedactionConfig(config.Redaction)...)
+	problems = append(problems, validateAuditConfig(config.Audit)...)
+	problems = append(problems, validateCacheConfig(config.Cache)...)
+	problems = append(problems, validateQueueConfig(config.Queue)...)
+	problems = append(problems, validateProxyPoolConfig(config.ProxyPool)...)
+	problems = append(problems, validateUpstreamClientConfig(config.UpstreamClient)...)
+	problems = append(problems, validateFingerprintConfig(config.Fingerprint)...)
+
 	if config.DDGChatAPIURL == "" {
-		logger.Error("DDG Chat API URL is required")
-		return fmt.Errorf("DDG Chat API URL is required")
+		problems = append(problems, ConfigProblem{Key: "ddg_chat_api_url", Message: "DDG Chat API URL is required"})
 	}
 
-	return nil
+	return problems
 }
@@ -0,0 +1,227 @@
+package ddgchat
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// CheckConfig runs ValidateConfig's checks plus checks that only catch
+// likely mistakes, and returns every problem found.
+func CheckConfig(config *Config) []ConfigProblem {
+	problems := validateConfig(config)
+
+	if config.DDGChatAPIURL != "" {
+		if u, err := url.Parse(config.DDGChatAPIURL); err != nil {
+			problems = append(problems, ConfigProblem{Key: "ddg_chat_api_url", Message: fmt.Sprintf("invalid URL: %v", err)})
+		} else if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			problems = append(problems, ConfigProblem{Key: "ddg_chat_api_url", Message: fmt.Sprintf("URL must be absolute http(s): %s", config.DDGChatAPIURL)})
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, token := range config.Tokens {
+		switch {
+		case token == "":
+			problems = append(problems, ConfigProblem{Key: "tokens", Message: fmt.Sprintf("token #%d is empty", i+1)})
+		case seen[token]:
+			problems = append(problems, ConfigProblem{Key: "tokens", Message: fmt.Sprintf("token #%d is a duplicate", i+1)})
+		}
+		seen[token] = true
+	}
+	for name, token := range config.TokenNames {
+		switch {
+		case token == "":
+			problems = append(problems, ConfigProblem{Key: "token_names." + name, Message: "token is empty"})
+		case seen[token]:
+			problems = append(problems, ConfigProblem{Key: "token_names." + name, Message: "token is a duplicate"})
+		}
+		seen[token] = true
+	}
+
+	if len(config.ModelMapping) == 0 {
+		problems = append(problems, ConfigProblem{Key: "model_mapping", Message: "no models are mapped"})
+	}
+	for model, upstream := range config.ModelMapping {
+		if model == "" || upstream.Model == "" {
+			problems = append(problems, ConfigProblem{Key: "model_mapping." + model, Message: "model names must not be empty"})
+		}
+	}
+
+	for _, env := range []string{"https_proxy", "HTTPS_PROXY", "http_proxy", "HTTP_PROXY"} {
+		if proxy := os.Getenv(env); proxy != "" {
+			if err := checkProxyURL(proxy); err != nil {
+				problems = append(problems, ConfigProblem{Key: "$" + env, Message: err.Error()})
+			}
+		}
+	}
+
+	return problems
+}
+
+func checkProxyURL(proxy string) error {
+	// 与 net/http 一样，没有 scheme 时按 http 处理
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return fmt.Errorf("invalid proxy URL: %v", err)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("proxy URL must include a host")
+	}
+	return nil
+}
+
+// CheckConfigFile decodes configPath on top of the defaults and checks it
+// with CheckConfig. Problems carry the line of the offending key when it can
+// be found, and unknown keys are reported as well.
+func CheckConfigFile(configPath string) ([]ConfigProblem, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	config := DefaultConfig()
+	config.ModelMapping = nil
+	md, err := toml.Decode(string(data), config)
+	if err != nil {
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			return []ConfigProblem{{Line: parseErr.Position.Line, Message: parseErr.Message}}, nil
+		}
+		return []ConfigProblem{{Message: err.Error()}}, nil
+	}
+	if !md.IsDefined("model_mapping") {
+		config.ModelMapping = DefaultConfig().ModelMapping
+	}
+
+	lines := configKeyLines(data)
+	var problems []ConfigProblem
+	for _, key := range md.Undecoded() {
+		// model_mapping 的表由 ModelEntry.UnmarshalTOML 自己检查
+		if len(key) == 3 && key[0] == "model_mapping" {
+			continue
+		}
+		// 内容策略的分类由 PolicyList.UnmarshalTOML 自己检查
+		if len(key) == 6 && key[0] == "content_policy" && key[1] == "groups" && key[3] == "categories" {
+			continue
+		}
+		problems = append(problems, ConfigProblem{Key: key.String(), Message: "unknown key"})
+	}
+	problems = append(problems, CheckConfig(config)...)
+
+	for i := range problems {
+		problems[i].Line = lookupKeyLine(lines, problems[i].Key)
+	}
+	return problems, nil
+}
+
+// configKeyLines maps dotted keys to the line they are defined on. It only
+// understands the subset of TOML used by config files: table headers and
+// "key = value" lines.
+func configKeyLines(data []byte) map[string]int {
+	lines := make(map[string]int)
+	table := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			table = strings.Trim(strings.SplitN(line, "]", 2)[0], "[ ")
+			table = unquoteKeyPath(table)
+			if _, ok := lines[table]; !ok {
+				lines[table] = n
+			}
+			continue
+		}
+
+		key, _, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key = unquoteKeyPath(strings.TrimSpace(key))
+		if table != "" {
+			key = table + "." + key
+		}
+		if _, ok := lines[key]; !ok {
+			lines[key] = n
+		}
+	}
+	return lines
+}
+
+func unquoteKeyPath(key string) string {
+	return strings.NewReplacer(`"`, "", "'", "").Replace(key)
+}
+
+// lookupKeyLine finds the line of key, falling back to its parent tables.
+func lookupKeyLine(lines map[string]int, key string) int {
+	key = unquoteKeyPath(key)
+	for key != "" {
+		if line, ok := lines[key]; ok {
+			return line
+		}
+		i := strings.LastIndex(key, ".")
+		if i < 0 {
+			break
+		}
+		key = key[:i]
+	}
+	return 0
+}
+
+// RedactConfig returns a copy of config with every field tagged secret
+// replaced by a placeholder, suitable for printing.
+func RedactConfig(config *Config) *Config {
+	redacted := *config
+	redactValue(reflect.ValueOf(&redacted).Elem())
+	return &redacted
+}
+
+func redactValue(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		value := v.Field(i)
+
+		if field.Tag.Get("secret") != "true" {
+			if value.Kind() == reflect.Struct {
+				redactValue(value)
+			}
+			continue
+		}
+
+		switch value.Kind() {
+		case reflect.String:
+			if value.String() != "" {
+				value.SetString("<redacted>")
+			}
+		case reflect.Slice:
+			items := reflect.MakeSlice(value.Type(), value.Len(), value.Len())
+			for j := 0; j < value.Len(); j++ {
+				items.Index(j).SetString("<redacted>")
+			}
+			value.Set(items)
+		case reflect.Map:
+			items := reflect.MakeMap(value.Type())
+			for _, key := range value.MapKeys() {
+				items.SetMapIndex(key, reflect.ValueOf("<redacted>").Convert(value.Type().Elem()))
+			}
+			value.Set(items)
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package ddgchat
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+// 内容策略检查的方向
+const (
+	policyInput  = "input"
+	policyOutput = "output"
+)
+
+var policyDirections = []string{policyInput, policyOutput}
+
+type ContentPolicyConfig struct {
+	// 检查发往上游的消息和上游的回复
+	Enabled bool `toml:"enabled"`
+	// 流式回复中留到下一个 chunk 再发送的字节数，用于发现跨 chunk 的匹配
+	LookBehind int `toml:"look_behind"`
+	// 没有列在任何组中的 token 使用的组，为空时不检查
+	DefaultGroup string `toml:"default_group"`
+	// 按组名
+	Groups map[string]PolicyGroup `toml:"groups"`
+}
+
+// PolicyGroup holds the blocklists applied to the requests of some tokens.
+type PolicyGroup struct {
+	// 使用这个组的 token 名称
+	Tokens []string `toml:"tokens"`
+	// input 检查请求，output 检查回复，为空时都检查
+	Apply []string `toml:"apply"`
+	// 按分类名，分类名出现在 /v1/moderations 的结果中
+	Categories map[string]PolicyList `toml:"categories"`
+}
+
+// PolicyList is the blocklist of one category.
+type PolicyList struct {
+	// 不区分大小写的整词匹配
+	Keywords []string `toml:"keywords"`
+	Patterns []string `toml:"patterns"`
+}
+
+// UnmarshalTOML checks the keys of a list itself, the metadata of the toml
+// decoder mixes up the keys of inline tables nested this deep.
+func (l *PolicyList) UnmarshalTOML(data interface{}) error {
+	value, ok := data.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("content_policy category must be a table, got %T", data)
+	}
+	var list PolicyList
+	for key, item := range value {
+		var err error
+		switch key {
+		case "keywords":
+			list.Keywords, err = tomlStrings(key, item)
+		case "patterns":
+			list.Patterns, err = tomlStrings(key, item)
+		default:
+			err = fmt.Errorf("unknown key %q in content_policy category", key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	*l = list
+	return nil
+}
+
+func defaultContentPolicyConfig() ContentPolicyConfig {
+	return ContentPolicyConfig{
+		LookBehind: 64,
+	}
+}
+
+func validateContentPolicyConfig(config ContentPolicyConfig) []ConfigProblem {
+	if !config.Enabled {
+		return nil
+	}
+
+	var problems []ConfigProblem
+	if config.LookBehind < 0 {
+		problems = append(problems, ConfigProblem{Key: "content_policy.look_behind", Message: "must not be negative"})
+	}
+	if _, ok := config.Groups[config.DefaultGroup]; config.DefaultGroup != "" && !ok {
+		problems = append(problems, ConfigProblem{Key: "content_policy.default_group", Message: fmt.Sprintf("group %s does not exist", config.DefaultGroup)})
+	}
+
+	owners := make(map[string]string)
+	for _, name := range slices.Sorted(maps.Keys(config.Groups)) {
+		group := config.Groups[name]
+		key := "content_policy.groups." + name
+		for _, token := range group.Tokens {
+			if owners[token] != "" {
+				problems = append(problems, ConfigProblem{Key: key + ".tokens", Message: fmt.Sprintf("token %s is already in group %s", token, owners[token])})
+				continue
+			}
+			owners[token] = name
+		}
+		for _, direction := range group.Apply {
+			if !slices.Contains(policyDirections, direction) {
+				problems = append(problems, ConfigProblem{Key: key + ".apply", Message: fmt.Sprintf("unknown direction %q, use %s", direction, strings.Join(policyDirections, " or "))})
+			}
+		}
+		if len(group.Categories) == 0 {
+			problems = append(problems, ConfigProblem{Key: key + ".categories", Message: "at least one category is required"})
+		}
+		for _, category := range slices.Sorted(maps.Keys(group.Categories)) {
+			list := group.Categories[category]
+			if len(list.Keywords) == 0 && len(list.Patterns) == 0 {
+				problems = append(problems, ConfigProblem{Key: key + ".categories." + category, Message: "set keywords or patterns"})
+			}
+			if slices.Contains(list.Keywords, "") {
+				problems = append(problems, ConfigProblem{Key: key + ".categories." + category, Message: "keywords must not be empty"})
+			}
+			for _, pattern := range list.Patterns {
+				if _, err := regexp.Compile(pattern); err != nil {
+					problems = append(problems, ConfigProblem{Key: key + ".categories." + category, Message: fmt.Sprintf("invalid pattern: %v", err)})
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// compiledPolicy is a PolicyGroup ready for matching.
+type compiledPolicy struct {
+	name   string
+	input  bool
+	output bool
+	// 排序后的分类名和对应的规则
+	categories []string
+	matchers   [][]*regexp.Regexp
+}
+
+// match returns the categories whose lists match text.
+func (p *compiledPolicy) match(text string) []string {
+	var flagged []string
+	for i, category := range p.categories {
+		for _, re := range p.matchers[i] {
+			if re.MatchString(text) {
+				flagged = append(flagged, category)
+				break
+			}
+		}
+	}
+	return flagged
+}
+
+// policyMatch is a match of a category at text[start:end].
+type policyMatch struct {
+	category   string
+	start, end int
+}
+
+// locate returns every match of every category in text.
+func (p *compiledPolicy) locate(text string) []policyMatch {
+	var matches []policyMatch
+	for i, category := range p.categories {
+		for _, re := range p.matchers[i] {
+			for _, loc := range re.FindAllStringIndex(text, -1) {
+				matches = append(matches, policyMatch{category: category, start: loc[0], end: loc[1]})
+			}
+		}
+	}
+	return matches
+}
+
+func compilePolicy(name string, group PolicyGroup) *compiledPolicy {
+	p := &compiledPolicy{
+		name:       name,
+		input:      len(group.Apply) == 0 || slices.Contains(group.Apply, policyInput),
+		output:     len(group.Apply) == 0 || slices.Contains(group.Apply, policyOutput),
+		categories: slices.Sorted(maps.Keys(group.Categories)),
+	}
+	for _, category := range p.categories {
+		list := group.Categories[category]
+		var matchers []*regexp.Regexp
+		if len(list.Keywords) > 0 {
+			words := make([]string, len(list.Keywords))
+			for i, keyword := range list.Keywords {
+				words[i] = keywordPattern(keyword)
+			}
+			matchers = append(matchers, regexp.MustCompile("(?i)(?:"+strings.Join(words, "|")+")"))
+		}
+		for _, pattern := range list.Patterns {
+			// 无效的规则已被配置检查拒绝，这里跳过
+			if re, err := regexp.Compile(pattern); err == nil {
+				matchers = append(matchers, re)
+			}
+		}
+		p.matchers = append(p.matchers, matchers)
+	}
+	return p
+}
+
+// keywordPattern matches keyword as a whole word. Word boundaries are only
+// required next to letters and digits, so keywords like "c++" still match.
+func keywordPattern(keyword string) string {
+	pattern := regexp.QuoteMeta(keyword)
+	if first, _ := utf8.DecodeRuneInString(keyword); isWordRune(first) {
+		pattern = `\b` + pattern
+	}
+	if last, _ := utf8.DecodeLastRuneInString(keyword); isWordRune(last) {
+		pattern += `\b`
+	}
+	return pattern
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// policySet maps token names to their compiled policy.
+type policySet struct {
+	groups       map[string]*compiledPolicy
+	tokens       map[string]string
+	defaultGroup string
+}
+
+// forToken returns the policy of tokenName, nil if it has none.
+func (s *policySet) forToken(tokenName string) *compiledPolicy {
+	if s == nil {
+		return nil
+	}
+	if name, ok := s.tokens[tokenName]; ok {
+		return s.groups[name]
+	}
+	return s.groups[s.defaultGroup]
+}
+
+// compilePolicySet builds the policies of config, nil when the content
+// policy is off.
+func compilePolicySet(config ContentPolicyConfig) *policySet {
+	if !config.Enabled {
+		return nil
+	}
+
+	set := &policySet{
+		groups:       make(map[string]*compiledPolicy, len(config.Groups)),
+		tokens:       make(map[string]string),
+		defaultGroup: config.DefaultGroup,
+	}
+	for name, group := range config.Groups {
+		set.groups[name] = compilePolicy(name, group)
+		for _, token := range group.Tokens {
+			set.tokens[token] = name
+		}
+	}
+	return set
+}
+
+// policyHook applies the content policy of the token of each request.
+type policyHook struct {
+	NopHook
+	set        *policySet
+	lookBehind int
+}
+
+func (h *policyHook) PreRequest(ctx context.Context, req *ChatCompletionRequest) error {
+	info := requestInfoFromContext(ctx)
+	policy := h.set.forToken(info.getTokenName())
+	if policy == nil || !policy.input {
+		return nil
+	}
+
+	// 历史中的回复已经在输出时检查过
+	for _, msg := range req.Messages {
+		if msg.Role == "assistant" {
+			continue
+		}
+		if flagged := policy.match(msg.Content); len(flagged) > 0 {
+			contentFiltered(ctx, policy, policyInput, flagged)
+			return &blockedError{message: fmt.Sprintf("the request was flagged by the content policy: %s", strings.Join(flagged, ", "))}
+		}
+	}
+	return nil
+}
+
+func (h *policyHook) TransformChunks(ctx context.Context, req *ChatCompletionRequest) ChunkTransformer {
+	policy := h.set.forToken(requestInfoFromContext(ctx).getTokenName())
+	if policy == nil || !policy.output {
+		return nil
+	}
+	return &policyTransformer{ctx: ctx, policy: policy, lookBehind: h.lookBehind}
+}
+
+// policyTransformer checks a reply against the policy. It holds back the
+// last lookBehind bytes, and any match reaching into them, until the next
+// chunk shows how they continue, so a match across chunks is blocked before
+// any of it is sent. The end of the sent text is kept to check matches
+// that start in it.
+type policyTransformer struct {
+	ctx        context.Context
+	policy     *compiledPolicy
+	lookBehind int
+	sent       string
+	pending    string
+}
+
+func (t *policyTransformer) Transform(chunk string) (string, error) {
+	t.pending += chunk
+	window := t.sent + t.pending
+	base := len(t.sent)
+	cut := max(len(window)-t.lookBehind, base)
+	matches := t.policy.locate(window)
+
+	// 跨过 cut 的匹配整个留到下一次，它的结尾还可能随后续内容变化
+	for moved := true; moved; {
+		moved = false
+		for _, m := range matches {
+			if cut > base && m.start < cut && m.end > cut {
+				cut = max(m.start, base)
+				moved = true
+			}
+		}
+	}
+	for cut > base && cut < len(window) && !utf8.RuneStart(window[cut]) {
+		cut--
+	}
+
+	// 只检查结束在未发送内容中且后面已有内容的匹配，已发送部分的匹配之前检查过
+	if err := t.check(matches, base, cut); err != nil {
+		return "", err
+	}
+	return t.release(window, base, cut), nil
+}
+
+func (t *policyTransformer) Flush() (string, error) {
+	window := t.sent + t.pending
+	base := len(t.sent)
+	if err := t.check(t.policy.locate(window), base, len(window)); err != nil {
+		return "", err
+	}
+	return t.release(window, base, len(window)), nil
+}
+
+// check blocks the reply if a match ends in window[base:cut].
+func (t *policyTransformer) check(matches []policyMatch, base, cut int) error {
+	var flagged []string
+	for _, m := range matches {
+		if m.end > base && m.end <= cut && !slices.Contains(flagged, m.category) {
+			flagged = append(flagged, m.category)
+		}
+	}
+	if len(flagged) == 0 {
+		return nil
+	}
+	slices.Sort(flagged)
+	contentFiltered(t.ctx, t.policy, policyOutput, flagged)
+	return ErrBlocked
+}
+
+// release returns window[base:cut], keeps the rest pending and the last
+// lookBehind bytes before cut as the sent text. The sent text starts at a
+// word boundary so that keywords are not found in the middle of a word.
+func (t *policyTransformer) release(window string, base, cut int) string {
+	start := max(cut-t.lookBehind, 0)
+	for start < cut && !utf8.RuneStart(window[start]) {
+		start++
+	}
+	if start > 0 {
+		// 跳过被截断的词
+		for start < cut {
+			prev, _ := utf8.DecodeLastRuneInString(window[:start])
+			r, size := utf8.DecodeRuneInString(window[start:])
+			if !isWordRune(prev) || !isWordRune(r) {
+				break
+			}
+			start += size
+		}
+	}
+	t.sent = window[start:cut]
+	t.pending = window[cut:]
+	return window[base:cut]
+}
+
+func contentFiltered(ctx context.Context, policy *compiledPolicy, direction string, flagged []string) {
+	for _, category := range flagged {
+		contentFilteredTotal.WithLabelValues(direction, category).Inc()
+	}
+	loggerFromContext(ctx).Info("content policy matched", zap.String("group", policy.name), zap.String("direction", direction), zap.Strings("categories", flagged))
+}
+
+// outputFlagged reports whether the policy of tokenName would block text as
+// a reply, used for cached replies that skip the hooks.
+func outputFlagged(config *Config, tokenName string, text string) bool {
+	policy := config.state().policies.forToken(tokenName)
+	return policy != nil && policy.output && len(policy.match(text)) > 0
+}
+
+// moderate checks input against the policy of tokenName for /v1/moderations.
+func moderate(config *Config, tokenName string, input string) ModerationResult {
+	result := ModerationResult{
+		Categories:     make(map[string]bool),
+		CategoryScores: make(map[string]float64),
+	}
+	policy := config.state().policies.forToken(tokenName)
+	if policy == nil {
+		return result
+	}
+
+	flagged := policy.match(input)
+	for _, category := range policy.categories {
+		matched := slices.Contains(flagged, category)
+		result.Categories[category] = matched
+		result.CategoryScores[category] = 0
+		if matched {
+			result.CategoryScores[category] = 1
+		}
+	}
+	result.Flagged = len(flagged) > 0
+	return result
+}
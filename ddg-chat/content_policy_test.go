@@ -0,0 +1,156 @@
+package ddgchat
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func newTestPolicyTransformer(lookBehind int, list PolicyList) *policyTransformer {
+	policy := compilePolicy("default", PolicyGroup{Categories: map[string]PolicyList{"banned": list}})
+	return &policyTransformer{ctx: context.Background(), policy: policy, lookBehind: lookBehind}
+}
+
+// streamThrough sends chunks through t and returns what reached the client
+// and the error that ended the reply.
+func streamThrough(t *policyTransformer, chunks ...string) (string, error) {
+	var sent strings.Builder
+	for _, chunk := range chunks {
+		out, err := t.Transform(chunk)
+		if err != nil {
+			return sent.String(), err
+		}
+		sent.WriteString(out)
+	}
+	rest, err := t.Flush()
+	if err != nil {
+		return sent.String(), err
+	}
+	sent.WriteString(rest)
+	return sent.String(), nil
+}
+
+func TestPolicyTransformer(t *testing.T) {
+	tests := []struct {
+		name       string
+		lookBehind int
+		list       PolicyList
+		chunks     []string
+		blocked    bool
+		// 被拦截时不能发送给客户端的内容
+		neverSent string
+	}{
+		{
+			name:       "word containing a keyword cut by the look-behind",
+			lookBehind: 64,
+			list:       PolicyList{Keywords: []string{"ass"}},
+			chunks:     []string{"AAAAAAAAAA class" + strings.Repeat(".", 61), " fine"},
+		},
+		{
+			name:       "word containing a keyword split across chunks",
+			lookBehind: 8,
+			list:       PolicyList{Keywords: []string{"bad"}},
+			chunks:     []string{"a very long sentence ending in bad", "ge of honour"},
+		},
+		{
+			name:       "multi-byte text around the cut",
+			lookBehind: 5,
+			list:       PolicyList{Keywords: []string{"bad"}},
+			chunks:     []string{"héllo wörld, ça", "va très bien ", "ünïcödé"},
+		},
+		{
+			name:       "keyword in one chunk",
+			lookBehind: 64,
+			list:       PolicyList{Keywords: []string{"secret"}},
+			chunks:     []string{"the ", "secret is out", " now"},
+			blocked:    true,
+			neverSent:  "secret",
+		},
+		{
+			name:       "keyword across chunks",
+			lookBehind: 16,
+			list:       PolicyList{Keywords: []string{"password"}},
+			chunks:     []string{"here comes the pass", "word you asked for"},
+			blocked:    true,
+			neverSent:  "pass",
+		},
+		{
+			name:       "keyword across chunks after a long chunk",
+			lookBehind: 8,
+			list:       PolicyList{Keywords: []string{"password"}},
+			chunks:     []string{strings.Repeat("a", 40) + " pass", "word"},
+			blocked:    true,
+			neverSent:  "pass",
+		},
+		{
+			name:       "pattern across three chunks",
+			lookBehind: 16,
+			list:       PolicyList{Patterns: []string{`\d{4}-\d{4}-\d{4}`}},
+			chunks:     []string{"card 1234-", "5678", "-9012 ok"},
+			blocked:    true,
+			neverSent:  "1234",
+		},
+		{
+			name:       "keyword at the end of the reply",
+			lookBehind: 64,
+			list:       PolicyList{Keywords: []string{"bad"}},
+			chunks:     []string{"this is ", "bad"},
+			blocked:    true,
+			neverSent:  "bad",
+		},
+		{
+			name:       "two-word keyword after a long chunk",
+			lookBehind: 64,
+			list:       PolicyList{Keywords: []string{"very bad"}},
+			chunks:     []string{strings.Repeat("x", 70) + " very", " bad"},
+			blocked:    true,
+			neverSent:  "very",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent, err := streamThrough(newTestPolicyTransformer(tt.lookBehind, tt.list), tt.chunks...)
+			if !tt.blocked {
+				if err != nil {
+					t.Fatalf("blocked a harmless reply: %v", err)
+				}
+				if want := strings.Join(tt.chunks, ""); sent != want {
+					t.Fatalf("sent %q, want %q", sent, want)
+				}
+				return
+			}
+			if !errors.Is(err, ErrBlocked) {
+				t.Fatalf("err = %v, want ErrBlocked", err)
+			}
+			if strings.Contains(sent, tt.neverSent) {
+				t.Errorf("%q was sent before the block: %q", tt.neverSent, sent)
+			}
+		})
+	}
+}
+
+func TestPolicyTransformerHoldsBack(t *testing.T) {
+	transformer := newTestPolicyTransformer(4, PolicyList{Keywords: []string{"bad"}})
+
+	out, err := transformer.Transform("good morning")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "good mor" {
+		t.Errorf("released %q, want all but the last 4 bytes", out)
+	}
+	if rest, err := transformer.Flush(); err != nil || rest != "ning" {
+		t.Errorf("flush = %q, %v, want the held back bytes", rest, err)
+	}
+}
+
+func TestPolicyTransformerWithoutLookBehind(t *testing.T) {
+	transformer := newTestPolicyTransformer(0, PolicyList{Keywords: []string{"bad"}})
+	if out, err := transformer.Transform("all good"); err != nil || out != "all good" {
+		t.Errorf("Transform = %q, %v, want the chunk unchanged", out, err)
+	}
+	if _, err := transformer.Transform(" but bad"); !errors.Is(err, ErrBlocked) {
+		t.Errorf("err = %v, want ErrBlocked", err)
+	}
+}
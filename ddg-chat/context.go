@@ -0,0 +1,140 @@
+package ddgchat
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+type contextKey int
+
+const (
+	requestInfoKey contextKey = iota
+)
+
+// requestInfo carries request-scoped values from the handlers down into the
+// upstream layer and collects what is reported in the request summary.
+type requestInfo struct {
+	id  string
+	log *requestLogger
+	// 响应缓存的 key，为空时不写入缓存，在请求开始前设置
+	cacheKey string
+
+	mu        sync.Mutex
+	tokenName string
+	err       error
+	// 实际回答的模型，启用 fallback 时可能不是请求的模型
+	modelUsed string
+
+	retries          atomic.Int64
+	promptTokens     atomic.Int64
+	completionTokens atomic.Int64
+}
+
+func newRequestInfo(id string) *requestInfo {
+	return &requestInfo{
+		id:  id,
+		log: newRequestLogger(zap.String("request_id", id)),
+	}
+}
+
+func (info *requestInfo) setTokenName(tokenName string) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.tokenName = tokenName
+	info.log = info.log.With(zap.String("token_name", tokenName))
+}
+
+func (info *requestInfo) getTokenName() string {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	return info.tokenName
+}
+
+func (info *requestInfo) logger() *requestLogger {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	return info.log
+}
+
+// setError records why the completion failed, for the summary line.
+func (info *requestInfo) setError(err error) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.err = err
+}
+
+func (info *requestInfo) getError() error {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	return info.err
+}
+
+func (info *requestInfo) setModelUsed(model string) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.modelUsed = model
+}
+
+// getModelUsed returns the model that answered, or requested if no
+// upstream call was made.
+func (info *requestInfo) getModelUsed(requested string) string {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	if info.modelUsed == "" {
+		return requested
+	}
+	return info.modelUsed
+}
+
+func withRequestInfo(ctx context.Context, info *requestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey, info)
+}
+
+// requestInfoFromContext never returns nil, background work such as health
+// checks gets an empty info that logs without request fields.
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{log: newRequestLogger()}
+}
+
+// loggerFromContext returns the request-scoped logger of ctx.
+func loggerFromContext(ctx context.Context) *requestLogger {
+	return requestInfoFromContext(ctx).logger()
+}
+
+// requestLogger adds fixed fields to every line written to the package
+// logger.
+type requestLogger struct {
+	fields []zap.Field
+}
+
+func newRequestLogger(fields ...zap.Field) *requestLogger {
+	return &requestLogger{fields: fields}
+}
+
+func (l *requestLogger) With(fields ...zap.Field) *requestLogger {
+	merged := make([]zap.Field, 0, len(l.fields)+len(fields))
+	merged = append(merged, l.fields...)
+	return &requestLogger{fields: append(merged, fields...)}
+}
+
+func (l *requestLogger) Debug(msg string, fields ...zap.Field) {
+	logger.Debug(msg, append(fields, l.fields...)...)
+}
+
+func (l *requestLogger) Info(msg string, fields ...zap.Field) {
+	logger.Info(msg, append(fields, l.fields...)...)
+}
+
+func (l *requestLogger) Warn(msg string, fields ...zap.Field) {
+	logger.Warn(msg, append(fields, l.fields...)...)
+}
+
+func (l *requestLogger) Error(msg string, fields ...zap.Field) {
+	logger.Error(msg, append(fields, l.fields...)...)
+}
@@ -0,0 +1,139 @@
+package ddgchat
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// 历史超出模型上下文窗口时的处理方式
+const (
+	contextPolicyDropOldest      = "drop_oldest"
+	contextPolicyKeepSystemLastN = "keep_system_last_n"
+	contextPolicyMiddleOut       = "middle_out"
+	contextPolicyStrict          = "strict"
+)
+
+var contextPolicies = []string{contextPolicyDropOldest, contextPolicyKeepSystemLastN, contextPolicyMiddleOut, contextPolicyStrict}
+
+type ContextConfig struct {
+	// drop_oldest、keep_system_last_n、middle_out 或 strict
+	Policy string `toml:"policy"`
+	// keep_system_last_n 保留的非 system 消息数
+	KeepLastN int `toml:"keep_last_n"`
+}
+
+func defaultContextConfig() ContextConfig {
+	return ContextConfig{
+		Policy:    contextPolicyDropOldest,
+		KeepLastN: 10,
+	}
+}
+
+func validateContextConfig(config ContextConfig) []ConfigProblem {
+	var problems []ConfigProblem
+	if !slices.Contains(contextPolicies, config.Policy) {
+		problems = append(problems, ConfigProblem{Key: "context.policy", Message: fmt.Sprintf("unknown policy %q, use one of %s", config.Policy, strings.Join(contextPolicies, ", "))})
+	}
+	if config.KeepLastN < 1 {
+		problems = append(problems, ConfigProblem{Key: "context.keep_last_n", Message: "must be at least 1"})
+	}
+	return problems
+}
+
+// fitContext drops messages of req until the estimated upstream payload
+// fits the context window of its model, minus max_tokens, and returns the kept
+// messages and how many were dropped. System messages and the last
+// message are never dropped; if they alone do not fit, or the policy is
+// strict, a context_length_exceeded error is returned.
+func fitContext(config *Config, req ChatCompletionRequest) ([]ChatMessage, int, *requestError) {
+	model, _ := modelInfo(config, req.Model)
+	if model.ContextWindow == 0 {
+		return req.Messages, 0, nil
+	}
+	budget := model.ContextWindow
+	if req.MaxTokens != nil {
+		budget -= *req.MaxTokens
+	}
+
+	messages := req.Messages
+	system, hasSystem := upstreamSystem(messages)
+	// 按实际发给上游的内容估算，见 upstreamMessages：assistant 和 system 消息
+	// 本身不发送，system 消息加在每条 user 消息前面
+	tokens := make([]int, len(messages))
+	total := 0
+	for i, msg := range messages {
+		if content, ok := upstreamContent(msg, system, hasSystem); ok {
+			tokens[i] = estimateTokens(content)
+		}
+		total += tokens[i]
+	}
+	exceeded := func() *requestError {
+		return newRequestError(fiber.StatusBadRequest, "context_length_exceeded", "messages", fmt.Sprintf("model %s has a context window of %d tokens, the messages have about %d", req.Model, model.ContextWindow, total))
+	}
+	if total <= budget {
+		return messages, 0, nil
+	}
+	if config.Context.Policy == contextPolicyStrict {
+		return nil, 0, exceeded()
+	}
+
+	// 可以删除的消息，从旧到新
+	var candidates []int
+	for i, msg := range messages {
+		if msg.Role != "system" && i != len(messages)-1 {
+			candidates = append(candidates, i)
+		}
+	}
+	keep := make([]bool, len(messages))
+	for i := range keep {
+		keep[i] = true
+	}
+	drop := func(i int) {
+		keep[i] = false
+		total -= tokens[i]
+	}
+
+	switch config.Context.Policy {
+	case contextPolicyKeepSystemLastN:
+		// 最后一条消息也算在 N 条之内
+		kept := 1
+		for j := len(candidates) - 1; j >= 0; j-- {
+			if kept < config.Context.KeepLastN {
+				kept++
+				continue
+			}
+			drop(candidates[j])
+		}
+	case contextPolicyMiddleOut:
+		// 保留第一轮（通常是任务描述）和最近的消息，从中间开始删除
+		for total > budget && len(candidates) > 1 {
+			middle := len(candidates) / 2
+			drop(candidates[middle])
+			candidates = slices.Delete(candidates, middle, middle+1)
+		}
+	}
+
+	// 仍然放不下时删除最旧的消息
+	for _, i := range candidates {
+		if total <= budget {
+			break
+		}
+		if keep[i] {
+			drop(i)
+		}
+	}
+	if total > budget {
+		return nil, 0, exceeded()
+	}
+
+	kept := make([]ChatMessage, 0, len(messages))
+	for i, msg := range messages {
+		if keep[i] {
+			kept = append(kept, msg)
+		}
+	}
+	return kept, len(messages) - len(kept), nil
+}
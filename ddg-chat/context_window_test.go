@@ -0,0 +1,54 @@
+package ddgchat
+
+import (
+	"strings"
+	"testing"
+)
+
+func contextTestConfig(window int) *Config {
+	config := DefaultConfig()
+	config.ModelMapping = map[string]ModelEntry{"small": {Model: "gpt-4o-mini", ContextWindow: window}}
+	return config
+}
+
+func TestFitContextCountsSystemPromptPerUserMessage(t *testing.T) {
+	// 30 个词的 system 消息会加在每条 user 消息前面发送
+	req := ChatCompletionRequest{Model: "small", Messages: []ChatMessage{
+		{Role: "system", Content: strings.Repeat("rule ", 29) + "rule"},
+		{Role: "user", Content: "one"},
+		{Role: "user", Content: "two"},
+		{Role: "user", Content: "three"},
+		{Role: "user", Content: "four"},
+	}}
+
+	messages, dropped, reqErr := fitContext(contextTestConfig(70), req)
+	if reqErr != nil {
+		t.Fatal(reqErr)
+	}
+	if dropped != 2 {
+		t.Errorf("dropped %d messages, want 2", dropped)
+	}
+	if messages[0].Role != "system" || messages[len(messages)-1].Content != "four" {
+		t.Errorf("kept %v, want the system and the last message", messages)
+	}
+}
+
+func TestFitContextIgnoresAssistantMessages(t *testing.T) {
+	// assistant 消息不会发给上游，不占用上下文
+	long := strings.Repeat("word ", 200)
+	req := ChatCompletionRequest{Model: "small", Messages: []ChatMessage{
+		{Role: "user", Content: "hi"},
+		{Role: "assistant", Content: long},
+		{Role: "user", Content: "more"},
+		{Role: "assistant", Content: long},
+		{Role: "user", Content: "thanks"},
+	}}
+
+	messages, dropped, reqErr := fitContext(contextTestConfig(100), req)
+	if reqErr != nil {
+		t.Fatal(reqErr)
+	}
+	if dropped != 0 || len(messages) != len(req.Messages) {
+		t.Errorf("dropped %d messages of a history that fits upstream", dropped)
+	}
+}
@@ -3,104 +3,159 @@ package ddgchat
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
-	"net"
-	"net/url"
-	"os"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/google/uuid"
 	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
-	"golang.org/x/exp/rand"
 )
 
 func generateUUID() string {
 	return uuid.New().String()
 }
 
-// Get VQD token from DuckDuckGo API for authentication
-func updateVQDToken(userAgent string, config *Config) (string, error) {
-	logger.Debug("updating VQD token")
-	client := createProxyClient()
+// Get VQD token from DuckDuckGo API for authentication. The token is tied to
+// the egress IP, so it must be used through the same upstream.
+func updateVQDToken(ctx context.Context, upstream *egressProxy, fp *fingerprint, config *Config) (vqdToken string, err error) {
+	reqLogger := loggerFromContext(ctx)
+	reqLogger.Debug("updating VQD token")
+	ctx, span := tracer.Start(ctx, "ddg.vqd")
+	defer func() {
+		if err != nil {
+			spanError(span, err)
+		}
+		span.End()
+	}()
 
 	req := fasthttp.AcquireRequest()
 	defer fasthttp.ReleaseRequest(req)
 
 	req.SetRequestURI(config.DDGChatAPIURL + "/country.json")
-	req.Header.Set("User-Agent", userAgent)
+	fp.apply(req)
 
 	resp := fasthttp.AcquireResponse()
 	defer fasthttp.ReleaseResponse(resp)
 
-	if err := client.Do(req, resp); err != nil {
-		logger.Error("failed to get country.json", zap.Error(err))
+	if err := doTraced(ctx, "GET /country.json", upstream, req, resp); err != nil {
+		reqLogger.Error("failed to get country.json", zap.Error(err))
+		vqdFetchFailures.Inc()
 		return "", err
 	}
 
 	req.Reset()
 	req.SetRequestURI(config.DDGChatAPIURL + "/duckchat/v1/status")
-	req.Header.Set("User-Agent", userAgent)
+	fp.apply(req)
 	req.Header.Set("x-vqd-accept", "1")
 
-	if err := client.Do(req, resp); err != nil {
-		logger.Error("failed to get duckchat/v1/status", zap.Error(err))
+	if err := doTraced(ctx, "GET /duckchat/v1/status", upstream, req, resp); err != nil {
+		reqLogger.Error("failed to get duckchat/v1/status", zap.Error(err))
+		vqdFetchFailures.Inc()
 		return "", err
 	}
 
-	vqdToken := string(resp.Header.Peek("x-vqd-4"))
+	vqdToken = string(resp.Header.Peek("x-vqd-4"))
 	if vqdToken == "" {
-		logger.Error("failed to get VQD token")
+		reqLogger.Error("failed to get VQD token")
+		vqdFetchFailures.Inc()
 		return "", fmt.Errorf("failed to get VQD token")
 	}
 
-	logger.Debug("got VQD token", zap.String("vqd_token", vqdToken))
+	reqLogger.Debug("got VQD token", zap.String("vqd_token", vqdToken))
 
 	return vqdToken, nil
 }
 
-// Main chat function to interact with DuckDuckGo API
-func chatWithDuckDuckGo(query string, model string, history []ChatMessage, channel chan string, config *Config) error {
-	logger.Debug("chat with duckduckgo", zap.String("query", query), zap.String("model", model))
-	originalModel := config.ModelMapping[model]
-	if originalModel == "" {
-		originalModel = model
-	}
-
-	var userAgent string
-	if config.UserAgent == "" {
-		userAgent = getRandomUserAgent()
-	} else {
-		userAgent = config.UserAgent
-	}
-	vqdToken, err := updateVQDToken(userAgent, config)
-	if err != nil {
-		return err
+// upstreamModel maps a model name exposed by the API to the DuckDuckGo
+// model name. Unknown names are passed through.
+func upstreamModel(config *Config, model string) string {
+	if mapped := modelMapping(config)[model].Model; mapped != "" {
+		return mapped
 	}
+	return model
+}
 
-	// Process system message and user messages
-	var systemMsg *ChatMessage
-	var userMsgs []map[string]string
+// upstreamMessages returns the messages DuckDuckGo receives for history.
+// The API has no system role, so the last system message is put in front
+// of every user message; assistant messages are not sent.
+func upstreamMessages(history []ChatMessage) []ChatMessage {
+	system, hasSystem := upstreamSystem(history)
 
+	var messages []ChatMessage
 	for _, msg := range history {
+		if content, ok := upstreamContent(msg, system, hasSystem); ok {
+			messages = append(messages, ChatMessage{Role: msg.Role, Content: content})
+		}
+	}
+	return messages
+}
+
+// upstreamSystem returns the last system message of history, which is the
+// one sent upstream.
+func upstreamSystem(history []ChatMessage) (string, bool) {
+	for _, msg := range slices.Backward(history) {
 		if msg.Role == "system" {
-			systemMsg = &msg
-		} else if msg.Role == "user" {
-			userMsgs = append(userMsgs, map[string]string{
-				"role":    msg.Role,
-				"content": msg.Content,
-			})
+			return msg.Content, true
 		}
 	}
+	return "", false
+}
 
-	// Combine system message with first user message if exists
-	if systemMsg != nil {
-		for i := range userMsgs {
-			userMsgs[i]["content"] = fmt.Sprintf("%s\n\n%s", systemMsg.Content, userMsgs[i]["content"])
+// upstreamContent returns the text sent for msg, false if it is not sent.
+func upstreamContent(msg ChatMessage, system string, hasSystem bool) (string, bool) {
+	if msg.Role != "user" {
+		return "", false
+	}
+	if hasSystem {
+		return fmt.Sprintf("%s\n\n%s", system, msg.Content), true
+	}
+	return msg.Content, true
+}
+
+// Main chat function to interact with DuckDuckGo API
+func chatWithDuckDuckGo(ctx context.Context, query string, model string, history []ChatMessage, channel chan string, config *Config) (err error) {
+	reqLogger := loggerFromContext(ctx)
+	reqLogger.Debug("chat with duckduckgo", zap.String("query", query), zap.String("model", model))
+	originalModel := upstreamModel(config, model)
+
+	ctx, span := tracer.Start(ctx, "ddg.chat", trace.WithAttributes(
+		attribute.String("ddg.model", model),
+		attribute.String("ddg.upstream_model", originalModel),
+		attribute.String("ddg.token_name", requestInfoFromContext(ctx).getTokenName()),
+	))
+	defer func() {
+		if err != nil {
+			spanError(span, err)
 		}
+		span.End()
+	}()
+
+	// 获取 VQD 和发送聊天请求使用同一个出口代理
+	upstream := egressProxies.pick(config)
+	fp := fingerprints.pick(config)
+	span.SetAttributes(attribute.String("ddg.fingerprint", fp.profile))
+	vqdToken, err := updateVQDToken(ctx, upstream, fp, config)
+	if err != nil {
+		return &UpstreamError{Class: errorClassVQD, Err: err}
+	}
+
+	// 按配置把个人信息换成占位符，回复中再换回原来的内容
+	history, channel, finishRedaction := redactChat(ctx, config, history, channel)
+	defer finishRedaction()
+
+	var userMsgs []map[string]string
+	for _, msg := range upstreamMessages(history) {
+		userMsgs = append(userMsgs, map[string]string{
+			"role":    msg.Role,
+			"content": msg.Content,
+		})
 	}
 
 	payload := map[string]interface{}{
@@ -108,45 +163,82 @@ func chatWithDuckDuckGo(query string, model string, history []ChatMessage, chann
 		"model":    originalModel,
 	}
 
-	logger.Debug("payload", zap.Any("payload", payload))
+	reqLogger.Debug("payload", zap.Any("payload", payload))
 
-	client := createProxyClient()
 	req := fasthttp.AcquireRequest()
 	defer fasthttp.ReleaseRequest(req)
 
 	req.SetRequestURI(config.DDGChatAPIURL + "/duckchat/v1/chat")
 	req.Header.SetMethod("POST")
+	fp.apply(req)
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", userAgent)
 	req.Header.Set("x-vqd-4", vqdToken)
 
 	jsonPayload, _ := json.Marshal(payload)
 	req.SetBody(jsonPayload)
 
-	return streamDuckDuckGoResponse(client, req, channel, config)
+	return streamDuckDuckGoResponse(ctx, upstream, req, fp, channel, config)
 }
 
 // Handle streaming response from DuckDuckGo API with retry mechanism
-func streamDuckDuckGoResponse(client *fasthttp.Client, req *fasthttp.Request, channel chan string, config *Config) error {
+func streamDuckDuckGoResponse(ctx context.Context, upstream *egressProxy, req *fasthttp.Request, fp *fingerprint, channel chan string, config *Config) error {
+	info := requestInfoFromContext(ctx)
+	reqLogger := info.logger()
 	resp := fasthttp.AcquireResponse()
 	defer fasthttp.ReleaseResponse(resp)
 
-	req.SetConnectionClose()
+	maxRetries := 5
+	retryCount := 0
+	defer func() {
+		trace.SpanFromContext(ctx).SetAttributes(attribute.Int("ddg.retries", retryCount))
+	}()
+
+	var statusCode int
+	for {
+		if err := doTraced(ctx, "POST /duckchat/v1/chat", upstream, req, resp); err != nil {
+			return &UpstreamError{Class: errorClassNetwork, Err: fmt.Errorf("failed to send request: %v", err)}
+		}
+		statusCode = resp.StatusCode()
+		upstreamResponses.WithLabelValues(strconv.Itoa(statusCode)).Inc()
+		if statusCode != fasthttp.StatusTooManyRequests || retryCount >= maxRetries {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
-	if err := client.Do(req, resp); err != nil {
-		return fmt.Errorf("failed to send request: %v", err)
+		// Handle rate limiting with retries
+		retryCount++
+		info.retries.Add(1)
+		upstreamRetries.Inc()
+		reqLogger.Warn("rate limit exceeded, retrying", zap.Int("retry", retryCount), zap.Int("max_retries", maxRetries))
+
+		// 换一个浏览器指纹和出口代理重新获取 VQD
+		fp.remove(req)
+		fp = fingerprints.pick(config)
+		fp.apply(req)
+		upstream = egressProxies.pick(config)
+		vqdToken, err := updateVQDToken(ctx, upstream, fp, config)
+		if err != nil {
+			reqLogger.Error("failed to update VQD token for retry", zap.Error(err))
+			break
+		}
+		req.Header.Set("x-vqd-4", vqdToken)
 	}
 
-	statusCode := resp.StatusCode()
 	if statusCode != fasthttp.StatusOK {
-		return fmt.Errorf("unexpected status code: %d", statusCode)
+		return &UpstreamError{Class: statusErrorClass(statusCode), StatusCode: statusCode, Err: fmt.Errorf("unexpected status code: %d", statusCode)}
 	}
 
 	body := resp.Body()
 	reader := bufio.NewReader(bytes.NewReader(body))
 
-	maxRetries := 5
-	retryCount := 0
+	_, span := tracer.Start(ctx, "ddg.chat.stream")
+	chunkCount := 0
+	defer func() {
+		span.SetAttributes(attribute.Int("ddg.chunks", chunkCount))
+		span.End()
+	}()
 
 	for {
 		line, err := reader.ReadString('\n')
@@ -171,106 +263,18 @@ func streamDuckDuckGoResponse(client *fasthttp.Client, req *fasthttp.Request, ch
 			}
 
 			if err := json.Unmarshal([]byte(data), &jsonResponse); err != nil {
-				logger.Error("Error parsing JSON", zap.Error(err))
-				continue
-			}
-
-			channel <- jsonResponse.Message
-		}
-
-		// Handle rate limiting with retries
-		if statusCode == 429 && retryCount < maxRetries {
-			retryCount++
-			logger.Warn("Rate limit exceeded, retry attempt %d of %d", zap.Int("retryCount", retryCount), zap.Int("maxRetries", maxRetries))
-
-			var userAgent string
-			if config.UserAgent == "" {
-				userAgent = getRandomUserAgent()
-			} else {
-				userAgent = config.UserAgent
-			}
-			vqdToken, err := updateVQDToken(userAgent, config)
-			if err != nil {
-				logger.Error("Failed to update VQD token: %v", zap.Error(err))
+				reqLogger.Error("Error parsing JSON", zap.Error(err))
 				continue
 			}
 
-			req.Header.Set("User-Agent", userAgent)
-			req.Header.Set("x-vqd-4", vqdToken)
-
-			if err := client.Do(req, resp); err != nil {
-				logger.Error("Retry request failed: %v", zap.Error(err))
-				continue
+			chunkCount++
+			select {
+			case channel <- jsonResponse.Message:
+			case <-ctx.Done():
+				return ctx.Err()
 			}
-
-			body = resp.Body()
-			reader = bufio.NewReader(bytes.NewReader(body))
-			statusCode = resp.StatusCode()
-			continue
 		}
 	}
 
 	return nil
 }
-
-// Create HTTP client with proxy support if configured
-func createProxyClient() *fasthttp.Client {
-	proxyURL := os.Getenv("https_proxy")
-	if proxyURL == "" {
-		proxyURL = os.Getenv("HTTPS_PROXY")
-	}
-	if proxyURL == "" {
-		return &fasthttp.Client{}
-	}
-
-	parsedProxyURL, err := url.Parse(proxyURL)
-	if err != nil {
-		log.Printf("Error parsing proxy URL: %v", err)
-		return &fasthttp.Client{}
-	}
-	logger.Debug("parsed proxy URL", zap.String("proxy_url", parsedProxyURL.String()))
-
-	return &fasthttp.Client{
-		Dial: func(addr string) (net.Conn, error) {
-			logger.Debug("dialing to proxy", zap.String("addr", addr))
-			proxyConn, err := fasthttp.Dial(parsedProxyURL.Host)
-			if err != nil {
-				logger.Error("error connecting to proxy", zap.Error(err))
-				return nil, fmt.Errorf("error connecting to proxy: %w", err)
-			}
-
-			_, err = fmt.Fprintf(proxyConn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
-			if err != nil {
-				proxyConn.Close()
-				logger.Error("error sending CONNECT", zap.Error(err))
-				return nil, fmt.Errorf("error sending CONNECT: %w", err)
-			}
-
-			res := make([]byte, 1024)
-			n, err := proxyConn.Read(res)
-			if err != nil {
-				proxyConn.Close()
-				logger.Error("error reading CONNECT response", zap.Error(err))
-				return nil, fmt.Errorf("error reading CONNECT response: %w", err)
-			}
-
-			if !bytes.Contains(res[:n], []byte("200 Connection established")) {
-				proxyConn.Close()
-				logger.Error("proxy connection failed", zap.String("response", string(res[:n])))
-				return nil, fmt.Errorf("proxy connection failed: %s", res[:n])
-			}
-
-			return proxyConn, nil
-		},
-	}
-}
-
-func getRandomUserAgent() string {
-	userAgents := []string{
-		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
-		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
-		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Edge/120.0.0.0 Safari/537.36",
-		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Safari/605.1.15",
-		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"}
-	return userAgents[rand.Intn(len(userAgents))]
-}
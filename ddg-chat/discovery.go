@@ -0,0 +1,272 @@
+package ddgchat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+type DiscoveryConfig struct {
+	// 定期从上游获取可用的模型列表
+	Enabled  bool          `toml:"enabled"`
+	Interval time.Duration `toml:"interval"`
+	Timeout  time.Duration `toml:"timeout"`
+	// 返回模型列表的地址，相对于 ddg_chat_api_url
+	Path string `toml:"path"`
+	// 上游新增且没有配置的模型以这个前缀加入 /v1/models，为空时不加入
+	NewModelPrefix string `toml:"new_model_prefix"`
+}
+
+func defaultDiscoveryConfig() DiscoveryConfig {
+	return DiscoveryConfig{
+		Interval:       time.Hour,
+		Timeout:        15 * time.Second,
+		Path:           "/duckchat/v1/status",
+		NewModelPrefix: "ddg/",
+	}
+}
+
+func validateDiscoveryConfig(config DiscoveryConfig) []ConfigProblem {
+	if !config.Enabled {
+		return nil
+	}
+
+	var problems []ConfigProblem
+	if config.Interval <= 0 {
+		problems = append(problems, ConfigProblem{Key: "discovery.interval", Message: fmt.Sprintf("invalid interval: %s", config.Interval)})
+	}
+	if config.Timeout <= 0 {
+		problems = append(problems, ConfigProblem{Key: "discovery.timeout", Message: fmt.Sprintf("invalid timeout: %s", config.Timeout)})
+	}
+	if !strings.HasPrefix(config.Path, "/") {
+		problems = append(problems, ConfigProblem{Key: "discovery.path", Message: fmt.Sprintf("path must start with /: %s", config.Path)})
+	}
+	return problems
+}
+
+// DiscoveryStatus is the state of the upstream model discovery, served by
+// /health.
+type DiscoveryStatus struct {
+	LastRefresh    time.Time `json:"last_refresh"`
+	LastSuccess    time.Time `json:"last_success"`
+	LastError      string    `json:"last_error,omitempty"`
+	UpstreamModels []string  `json:"upstream_models"`
+	// 已配置但上游不再提供的模型
+	UnavailableModels []string `json:"unavailable_models,omitempty"`
+}
+
+type modelDiscoverer struct {
+	mu     sync.RWMutex
+	status DiscoveryStatus
+	// 上游提供的模型，获取成功过一次之后才有值
+	models map[string]bool
+}
+
+// 全局的上游模型列表
+var upstreamModels = &modelDiscoverer{}
+
+// run refreshes the model list immediately and then every Interval until
+// ctx is cancelled.
+func (d *modelDiscoverer) run(ctx context.Context, store *ConfigStore) {
+	for {
+		config := store.Get()
+		interval := config.Discovery.Interval
+		if config.Discovery.Enabled {
+			d.refresh(ctx, config)
+		} else {
+			// 关闭时定期确认配置是否重新开启
+			interval = 10 * time.Second
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (d *modelDiscoverer) refresh(ctx context.Context, config *Config) {
+	ctx, cancel := context.WithTimeout(ctx, config.Discovery.Timeout)
+	defer cancel()
+
+	models, err := fetchUpstreamModels(ctx, config)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.status.LastRefresh = time.Now()
+	if err != nil {
+		// 失败时保留上一次的列表，不把模型标记为不可用
+		d.status.LastError = err.Error()
+		discoveryFailures.Inc()
+		logger.Warn("upstream model discovery failed", zap.Error(err))
+		return
+	}
+
+	found := make(map[string]bool, len(models))
+	for _, model := range models {
+		found[model] = true
+	}
+	for model := range found {
+		if d.models != nil && !d.models[model] {
+			logger.Info("upstream model added", zap.String("model", model))
+		}
+	}
+	for model := range d.models {
+		if !found[model] {
+			logger.Warn("upstream model removed", zap.String("model", model))
+		}
+	}
+
+	d.models = found
+	d.status.LastError = ""
+	d.status.LastSuccess = d.status.LastRefresh
+	d.status.UpstreamModels = slices.Sorted(maps.Keys(found))
+}
+
+// available reports whether the upstream still offers model. Without
+// discovery, or before the first successful refresh, every model is
+// available.
+func (d *modelDiscoverer) available(config *Config, model string) bool {
+	if !config.Discovery.Enabled {
+		return true
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.models == nil || d.models[model]
+}
+
+// newModels returns the upstream models no model_mapping entry points to,
+// as entries named with new_model_prefix.
+func (d *modelDiscoverer) newModels(config *Config) map[string]ModelEntry {
+	if !config.Discovery.Enabled || config.Discovery.NewModelPrefix == "" {
+		return nil
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	mapped := make(map[string]bool, len(config.ModelMapping))
+	for _, entry := range config.ModelMapping {
+		mapped[entry.Model] = true
+	}
+	var entries map[string]ModelEntry
+	for model := range d.models {
+		id := config.Discovery.NewModelPrefix + model
+		if _, ok := config.ModelMapping[id]; mapped[model] || ok {
+			continue
+		}
+		if entries == nil {
+			entries = make(map[string]ModelEntry)
+		}
+		entries[id] = ModelEntry{Model: model}
+	}
+	return entries
+}
+
+// snapshot returns the discovery state for /health, nil when disabled.
+func (d *modelDiscoverer) snapshot(config *Config) *DiscoveryStatus {
+	if !config.Discovery.Enabled {
+		return nil
+	}
+	d.mu.RLock()
+	status := d.status
+	d.mu.RUnlock()
+
+	for _, model := range listModels(config) {
+		if !model.Available {
+			status.UnavailableModels = append(status.UnavailableModels, model.ID)
+		}
+	}
+	return &status
+}
+
+// fetchUpstreamModels reads the model list from the discovery endpoint.
+func fetchUpstreamModels(ctx context.Context, config *Config) ([]string, error) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(strings.TrimSuffix(config.DDGChatAPIURL, "/") + config.Discovery.Path)
+	fingerprints.pick(config).apply(req)
+	req.Header.Set("x-vqd-accept", "1")
+
+	if err := doTraced(ctx, "GET "+config.Discovery.Path, egressProxies.pick(config), req, resp); err != nil {
+		return nil, fmt.Errorf("failed to fetch models: %v", err)
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode())
+	}
+
+	var body interface{}
+	if err := json.Unmarshal(resp.Body(), &body); err != nil {
+		return nil, fmt.Errorf("invalid model list: %v", err)
+	}
+	models, ok := findModelList(body)
+	if !ok {
+		return nil, fmt.Errorf("no model list in the response of %s", config.Discovery.Path)
+	}
+	if len(models) == 0 {
+		return nil, fmt.Errorf("upstream returned an empty model list")
+	}
+	return models, nil
+}
+
+// findModelList looks for the first "models" array in a JSON document. Its
+// items are model names or objects with an "id", "model" or "name"; objects
+// with "available": false are skipped.
+func findModelList(value interface{}) ([]string, bool) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		if items, ok := value["models"].([]interface{}); ok {
+			return modelNames(items), true
+		}
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if models, ok := findModelList(value[key]); ok {
+				return models, true
+			}
+		}
+	case []interface{}:
+		for _, item := range value {
+			if models, ok := findModelList(item); ok {
+				return models, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func modelNames(items []interface{}) []string {
+	var names []string
+	for _, item := range items {
+		switch item := item.(type) {
+		case string:
+			names = append(names, item)
+		case map[string]interface{}:
+			if available, ok := item["available"].(bool); ok && !available {
+				continue
+			}
+			for _, key := range []string{"id", "model", "name"} {
+				if name, ok := item[key].(string); ok && name != "" {
+					names = append(names, name)
+					break
+				}
+			}
+		}
+	}
+	return names
+}
@@ -0,0 +1,212 @@
+package ddgchat
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// modelListStub serves body from the discovery endpoint, or status when it
+// is not 200.
+type modelListStub struct {
+	body   atomic.Value
+	status atomic.Int32
+	calls  atomic.Int32
+}
+
+func newModelListStub(t *testing.T, body string) (*modelListStub, *Config) {
+	t.Helper()
+	stub := &modelListStub{}
+	stub.body.Store(body)
+	stub.status.Store(http.StatusOK)
+	server := newStubUpstream(t, map[string]http.HandlerFunc{
+		"/duckchat/v1/status": func(w http.ResponseWriter, r *http.Request) {
+			stub.calls.Add(1)
+			if status := int(stub.status.Load()); status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+			fmt.Fprint(w, stub.body.Load().(string))
+		},
+	})
+
+	config := stubConfig(server)
+	config.Discovery.Enabled = true
+	return stub, config
+}
+
+// useDiscoverer replaces the global model list for the test.
+func useDiscoverer(t *testing.T) *modelDiscoverer {
+	t.Helper()
+	previous := upstreamModels
+	upstreamModels = &modelDiscoverer{}
+	t.Cleanup(func() { upstreamModels = previous })
+	return upstreamModels
+}
+
+func TestFetchUpstreamModels(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    []string
+		wantErr bool
+	}{
+		{name: "names", body: `{"models":["gpt-4o-mini","o3-mini"]}`, want: []string{"gpt-4o-mini", "o3-mini"}},
+		{
+			name: "objects",
+			body: `{"models":[{"id":"gpt-4o-mini"},{"model":"o3-mini"},{"name":"claude-3-haiku-20240307"},{"id":"retired","available":false}]}`,
+			want: []string{"gpt-4o-mini", "o3-mini", "claude-3-haiku-20240307"},
+		},
+		{name: "nested", body: `{"status":"0","data":{"chat":{"models":["gpt-4o-mini"]}}}`, want: []string{"gpt-4o-mini"}},
+		{name: "no list", body: `{"status":"0"}`, wantErr: true},
+		{name: "empty list", body: `{"models":[]}`, wantErr: true},
+		{name: "invalid json", body: `<html>`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, config := newModelListStub(t, tt.body)
+			models, err := fetchUpstreamModels(context.Background(), config)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %q, want an error", models)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(models, tt.want) {
+				t.Errorf("got %q, want %q", models, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiscoveryKeepsLastList(t *testing.T) {
+	stub, config := newModelListStub(t, `{"models":["gpt-4o-mini","o3-mini"]}`)
+	d := &modelDiscoverer{}
+
+	d.refresh(context.Background(), config)
+	first := *d.snapshot(config)
+	if first.LastError != "" || !slices.Equal(first.UpstreamModels, []string{"gpt-4o-mini", "o3-mini"}) {
+		t.Fatalf("first refresh: %+v", first)
+	}
+
+	stub.status.Store(http.StatusBadGateway)
+	d.refresh(context.Background(), config)
+	status := d.snapshot(config)
+	if status.LastError == "" {
+		t.Error("failed refresh did not record an error")
+	}
+	if !status.LastSuccess.Equal(first.LastSuccess) {
+		t.Errorf("last_success moved to %s after a failure", status.LastSuccess)
+	}
+	if !slices.Equal(status.UpstreamModels, first.UpstreamModels) {
+		t.Errorf("models = %q after a failure, want %q", status.UpstreamModels, first.UpstreamModels)
+	}
+	if !d.available(config, "o3-mini") {
+		t.Error("o3-mini unavailable after a failed refresh")
+	}
+
+	// 恢复后清除错误
+	stub.status.Store(http.StatusOK)
+	d.refresh(context.Background(), config)
+	if status := d.snapshot(config); status.LastError != "" {
+		t.Errorf("error %q kept after a successful refresh", status.LastError)
+	}
+}
+
+func TestDiscoveryRefreshesAfterInterval(t *testing.T) {
+	stub, config := newModelListStub(t, `{"models":["gpt-4o-mini"]}`)
+	config.Discovery.Interval = 20 * time.Millisecond
+	store := NewConfigStore("", config, nil)
+	d := &modelDiscoverer{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.run(ctx, store)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitFor := func(want []string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if slices.Equal(d.snapshot(config).UpstreamModels, want) {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("models = %q, want %q", d.snapshot(config).UpstreamModels, want)
+	}
+
+	waitFor([]string{"gpt-4o-mini"})
+	calls := stub.calls.Load()
+	stub.body.Store(`{"models":["gpt-4o-mini","o3-mini"]}`)
+	waitFor([]string{"gpt-4o-mini", "o3-mini"})
+	if stub.calls.Load() <= calls {
+		t.Error("model list changed without another request")
+	}
+}
+
+func TestDiscoveredModelsMerge(t *testing.T) {
+	stub, config := newModelListStub(t, `{"models":["gpt-4o-mini","o3-mini","claude-3-haiku-20240307"]}`)
+	config.ModelMapping = map[string]ModelEntry{
+		"gpt-4o-mini": {Model: "gpt-4o-mini"},
+		// 映射到上游模型的条目不会再以前缀加入
+		"claude": {Model: "claude-3-haiku-20240307"},
+		// 配置了名称的条目保留配置中的信息
+		"ddg/o3-mini": {Model: "o3-mini", DisplayName: "Configured o3"},
+		"llama":       {Model: "meta-llama/Meta-Llama-3.1-70B-Instruct-Turbo"},
+	}
+	d := useDiscoverer(t)
+
+	// 第一次获取成功之前只有配置的模型，并且都可用
+	for _, model := range listModels(config) {
+		if !model.Available {
+			t.Errorf("%s unavailable before the first refresh", model.ID)
+		}
+	}
+
+	d.refresh(context.Background(), config)
+	stub.body.Store(`{"models":["gpt-4o-mini","o3-mini","claude-3-haiku-20240307","gpt-5"]}`)
+	d.refresh(context.Background(), config)
+
+	models := listModels(config)
+	var ids []string
+	byID := make(map[string]ModelInfo)
+	for _, model := range models {
+		ids = append(ids, model.ID)
+		byID[model.ID] = model
+	}
+	if want := []string{"claude", "ddg/gpt-5", "ddg/o3-mini", "gpt-4o-mini", "llama"}; !slices.Equal(ids, want) {
+		t.Fatalf("models = %q, want %q", ids, want)
+	}
+	if name := byID["ddg/o3-mini"].DisplayName; name != "Configured o3" {
+		t.Errorf("ddg/o3-mini display name = %q, want the configured one", name)
+	}
+	if byID["llama"].Available {
+		t.Error("llama is available although the upstream no longer lists it")
+	}
+	if !byID["ddg/gpt-5"].Available {
+		t.Error("discovered ddg/gpt-5 is unavailable")
+	}
+	if status := d.snapshot(config); !slices.Equal(status.UnavailableModels, []string{"llama"}) {
+		t.Errorf("unavailable models = %q, want [llama]", status.UnavailableModels)
+	}
+
+	// 没有前缀时不加入新模型
+	config.Discovery.NewModelPrefix = ""
+	if _, ok := modelInfo(config, "ddg/gpt-5"); ok {
+		t.Error("ddg/gpt-5 listed without new_model_prefix")
+	}
+}
@@ -0,0 +1,83 @@
+package ddgchat
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	"go.uber.org/zap"
+)
+
+// 上游错误的分类，用于 model_mapping 的 fallback_on
+const (
+	errorClassRateLimit   = "rate_limit"
+	errorClassServerError = "server_error"
+	errorClassClientError = "client_error"
+	errorClassNetwork     = "network"
+	errorClassVQD         = "vqd"
+)
+
+var upstreamErrorClasses = []string{errorClassRateLimit, errorClassServerError, errorClassClientError, errorClassNetwork, errorClassVQD}
+
+// 没有配置 fallback_on 时，只有限流和上游服务错误会换模型
+var defaultFallbackOn = []string{errorClassRateLimit, errorClassServerError}
+
+// UpstreamError is a DuckDuckGo failure that happened before any part of
+// the reply was sent, so the request can still be retried with another
+// model.
+type UpstreamError struct {
+	Class string
+	// 上游的 HTTP 状态码，没有收到响应时为 0
+	StatusCode int
+	Err        error
+}
+
+func (e *UpstreamError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// statusErrorClass classifies an unexpected status code of the chat endpoint.
+func statusErrorClass(statusCode int) string {
+	switch {
+	case statusCode == 429:
+		return errorClassRateLimit
+	case statusCode >= 500:
+		return errorClassServerError
+	}
+	return errorClassClientError
+}
+
+// chatWithFallbacks calls chatWithDuckDuckGo with model and, while it fails
+// with one of the fallback_on classes of model's entry, with each of its
+// fallbacks in turn. onAttempt is called with the model of every attempt
+// before that attempt sends anything to channel.
+func chatWithFallbacks(ctx context.Context, query string, model string, history []ChatMessage, channel chan string, config *Config, onAttempt func(model string)) error {
+	entry := config.ModelMapping[model]
+	fallbackOn := entry.FallbackOn
+	if len(fallbackOn) == 0 {
+		fallbackOn = defaultFallbackOn
+	}
+
+	candidates := append([]string{model}, entry.Fallbacks...)
+	var err error
+	for i, candidate := range candidates {
+		if i > 0 {
+			loggerFromContext(ctx).Warn("falling back to another model", zap.String("model", candidates[i-1]), zap.String("fallback", candidate), zap.Error(err))
+			modelFallbacks.WithLabelValues(model, candidate).Inc()
+		}
+
+		onAttempt(candidate)
+		err = chatWithDuckDuckGo(ctx, query, candidate, history, channel, config)
+
+		// 已经输出了内容、请求被取消或者错误类型不在 fallback_on 中时不再重试
+		var upstreamErr *UpstreamError
+		if err == nil || ctx.Err() != nil || !errors.As(err, &upstreamErr) || !slices.Contains(fallbackOn, upstreamErr.Class) {
+			return err
+		}
+	}
+	return err
+}
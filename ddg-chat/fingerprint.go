@@ -0,0 +1,294 @@
+package ddgchat
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+	"golang.org/x/exp/rand"
+)
+
+type FingerprintConfig struct {
+	// 额外的 profile 文件（TOML，内容为 [[profiles]]），与下面的 profiles 合并
+	ProfilesFile string `toml:"profiles_file"`
+	// 多久重新计算一次 UA 里的浏览器版本号，0 表示只在启动时计算
+	RefreshInterval time.Duration `toml:"refresh_interval"`
+	// 为空且没有 profiles_file 时使用内置的 profile
+	Profiles []FingerprintProfile `toml:"profiles"`
+}
+
+// FingerprintProfile is a coherent set of browser headers sent to
+// DuckDuckGo. The user agent and header values may use the placeholders
+// {chrome_version}, {firefox_version} and {origin}.
+type FingerprintProfile struct {
+	Name string `toml:"name"`
+	// 相对权重，默认为 1
+	Weight    int               `toml:"weight"`
+	UserAgent string            `toml:"user_agent"`
+	Headers   map[string]string `toml:"headers"`
+}
+
+func defaultFingerprintConfig() FingerprintConfig {
+	return FingerprintConfig{
+		RefreshInterval: 24 * time.Hour,
+	}
+}
+
+func validateFingerprintConfig(config FingerprintConfig) []ConfigProblem {
+	var problems []ConfigProblem
+
+	if config.RefreshInterval < 0 {
+		problems = append(problems, ConfigProblem{Key: "fingerprint.refresh_interval", Message: fmt.Sprintf("must not be negative: %s", config.RefreshInterval)})
+	}
+
+	profiles := config.Profiles
+	if config.ProfilesFile != "" {
+		fileProfiles, err := loadFingerprintProfiles(config.ProfilesFile)
+		if err != nil {
+			problems = append(problems, ConfigProblem{Key: "fingerprint.profiles_file", Message: err.Error()})
+		}
+		profiles = append(append([]FingerprintProfile{}, profiles...), fileProfiles...)
+	}
+	for i, profile := range profiles {
+		name := profile.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+			problems = append(problems, ConfigProblem{Key: "fingerprint.profiles", Message: fmt.Sprintf("profile %s has no name", name)})
+		}
+		if profile.UserAgent == "" {
+			problems = append(problems, ConfigProblem{Key: "fingerprint.profiles", Message: fmt.Sprintf("profile %s has no user_agent", name)})
+		}
+		if profile.Weight < 0 {
+			problems = append(problems, ConfigProblem{Key: "fingerprint.profiles", Message: fmt.Sprintf("profile %s has a negative weight", name)})
+		}
+	}
+	return problems
+}
+
+// loadFingerprintProfiles reads the [[profiles]] of an external file.
+func loadFingerprintProfiles(path string) ([]FingerprintProfile, error) {
+	var file struct {
+		Profiles []FingerprintProfile `toml:"profiles"`
+	}
+	if _, err := toml.DecodeFile(path, &file); err != nil {
+		return nil, fmt.Errorf("failed to load fingerprint profiles: %v", err)
+	}
+	return file.Profiles, nil
+}
+
+// 内置的浏览器 profile，版本号由 browserVersions 按发布节奏推算
+func defaultFingerprintProfiles() []FingerprintProfile {
+	fetchHeaders := map[string]string{
+		"Accept":          "*/*",
+		"Accept-Language": "en-US,en;q=0.9",
+		"Origin":          "{origin}",
+		"Referer":         "{origin}/",
+		"Sec-Fetch-Dest":  "empty",
+		"Sec-Fetch-Mode":  "cors",
+		"Sec-Fetch-Site":  "same-origin",
+	}
+	with := func(extra map[string]string) map[string]string {
+		headers := make(map[string]string, len(fetchHeaders)+len(extra))
+		for key, value := range fetchHeaders {
+			headers[key] = value
+		}
+		for key, value := range extra {
+			headers[key] = value
+		}
+		return headers
+	}
+
+	return []FingerprintProfile{
+		{
+			Name:      "chrome-windows",
+			Weight:    4,
+			UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/{chrome_version}.0.0.0 Safari/537.36",
+			Headers: with(map[string]string{
+				"Sec-CH-UA":          `"Chromium";v="{chrome_version}", "Google Chrome";v="{chrome_version}", "Not?A_Brand";v="99"`,
+				"Sec-CH-UA-Mobile":   "?0",
+				"Sec-CH-UA-Platform": `"Windows"`,
+			}),
+		},
+		{
+			Name:      "chrome-mac",
+			Weight:    3,
+			UserAgent: "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/{chrome_version}.0.0.0 Safari/537.36",
+			Headers: with(map[string]string{
+				"Sec-CH-UA":          `"Chromium";v="{chrome_version}", "Google Chrome";v="{chrome_version}", "Not?A_Brand";v="99"`,
+				"Sec-CH-UA-Mobile":   "?0",
+				"Sec-CH-UA-Platform": `"macOS"`,
+			}),
+		},
+		{
+			Name:      "edge-windows",
+			Weight:    1,
+			UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/{chrome_version}.0.0.0 Safari/537.36 Edg/{chrome_version}.0.0.0",
+			Headers: with(map[string]string{
+				"Sec-CH-UA":          `"Chromium";v="{chrome_version}", "Microsoft Edge";v="{chrome_version}", "Not?A_Brand";v="99"`,
+				"Sec-CH-UA-Mobile":   "?0",
+				"Sec-CH-UA-Platform": `"Windows"`,
+			}),
+		},
+		{
+			Name:      "firefox-windows",
+			Weight:    1,
+			UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:{firefox_version}.0) Gecko/20100101 Firefox/{firefox_version}.0",
+			Headers: with(map[string]string{
+				"Accept-Language": "en-US,en;q=0.5",
+			}),
+		},
+		{
+			Name:      "safari-mac",
+			Weight:    1,
+			UserAgent: "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/18.0 Safari/605.1.15",
+			Headers:   with(nil),
+		},
+	}
+}
+
+// browserVersions estimates the current stable Chrome and Firefox major
+// versions from their four-week release cadence.
+func browserVersions(now time.Time) (chrome int, firefox int) {
+	const cycle = 28 * 24 * time.Hour
+	// Chrome 131 和 Firefox 133 的发布日期
+	chromeBase := time.Date(2024, time.November, 12, 0, 0, 0, 0, time.UTC)
+	firefoxBase := time.Date(2024, time.November, 26, 0, 0, 0, 0, time.UTC)
+
+	chrome = 131 + int(max(now.Sub(chromeBase), 0)/cycle)
+	firefox = 133 + int(max(now.Sub(firefoxBase), 0)/cycle)
+	return chrome, firefox
+}
+
+type fingerprintHeader struct {
+	key   string
+	value string
+}
+
+// fingerprint is a rendered profile, used for all requests of one chat.
+type fingerprint struct {
+	profile string
+	headers []fingerprintHeader
+}
+
+func (f *fingerprint) apply(req *fasthttp.Request) {
+	for _, header := range f.headers {
+		req.Header.Set(header.key, header.value)
+	}
+}
+
+// remove deletes the headers of f, before switching req to another
+// fingerprint.
+func (f *fingerprint) remove(req *fasthttp.Request) {
+	for _, header := range f.headers {
+		req.Header.Del(header.key)
+	}
+}
+
+// fingerprintSet renders the profiles of the current config with the
+// current browser versions.
+type fingerprintSet struct {
+	mu         sync.Mutex
+	versionsAt time.Time
+	chrome     int
+	firefox    int
+}
+
+// 全局浏览器指纹
+var fingerprints = &fingerprintSet{}
+
+// pick selects a profile by weight and renders it. A configured user_agent
+// replaces the profiles and is sent on its own.
+func (s *fingerprintSet) pick(config *Config) *fingerprint {
+	if config.UserAgent != "" {
+		return &fingerprint{profile: "user_agent", headers: []fingerprintHeader{{"User-Agent", config.UserAgent}}}
+	}
+
+	chrome, firefox := s.versions(config.Fingerprint.RefreshInterval)
+
+	profiles := config.state().profiles
+	total := 0
+	for _, profile := range profiles {
+		total += profileWeight(profile)
+	}
+	n := rand.Intn(total)
+	profile := profiles[0]
+	for _, candidate := range profiles {
+		if n < profileWeight(candidate) {
+			profile = candidate
+			break
+		}
+		n -= profileWeight(candidate)
+	}
+
+	replacer := strings.NewReplacer(
+		"{chrome_version}", strconv.Itoa(chrome),
+		"{firefox_version}", strconv.Itoa(firefox),
+		"{origin}", strings.TrimSuffix(config.DDGChatAPIURL, "/"),
+	)
+	rendered := &fingerprint{
+		profile: profile.Name,
+		headers: []fingerprintHeader{{"User-Agent", replacer.Replace(profile.UserAgent)}},
+	}
+	keys := make([]string, 0, len(profile.Headers))
+	for key := range profile.Headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		rendered.headers = append(rendered.headers, fingerprintHeader{key, replacer.Replace(profile.Headers[key])})
+	}
+	return rendered
+}
+
+// versions returns the browser versions, recomputed every refreshInterval.
+func (s *fingerprintSet) versions(refreshInterval time.Duration) (chrome int, firefox int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.versionsAt.IsZero() || (refreshInterval > 0 && now.Sub(s.versionsAt) >= refreshInterval) {
+		s.chrome, s.firefox = browserVersions(now)
+		s.versionsAt = now
+		logger.Debug("refreshed browser versions", zap.Int("chrome", s.chrome), zap.Int("firefox", s.firefox))
+	}
+	return s.chrome, s.firefox
+}
+
+// compileFingerprintProfiles returns the usable profiles of config and its
+// profiles file, or the built-in profiles if there are none.
+func compileFingerprintProfiles(config FingerprintConfig) []FingerprintProfile {
+	profiles := append([]FingerprintProfile{}, config.Profiles...)
+	if config.ProfilesFile != "" {
+		fileProfiles, err := loadFingerprintProfiles(config.ProfilesFile)
+		if err != nil {
+			// 配置检查时文件还能读取，之后又被改坏或删除
+			logger.Error("ignoring fingerprint profiles file", zap.Error(err))
+		}
+		profiles = append(profiles, fileProfiles...)
+	}
+
+	// 去掉不完整的 profile
+	usable := profiles[:0]
+	for _, profile := range profiles {
+		if profile.UserAgent != "" && profile.Weight >= 0 {
+			usable = append(usable, profile)
+		}
+	}
+	if len(usable) == 0 {
+		usable = defaultFingerprintProfiles()
+	}
+	return usable
+}
+
+func profileWeight(profile FingerprintProfile) int {
+	if profile.Weight == 0 {
+		return 1
+	}
+	return profile.Weight
+}
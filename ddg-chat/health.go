@@ -0,0 +1,199 @@
+package ddgchat
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+type HealthConfig struct {
+	// 关闭后 /ready 只反映服务是否正在关闭
+	Enabled  bool          `toml:"enabled"`
+	Interval time.Duration `toml:"interval"`
+	Timeout  time.Duration `toml:"timeout"`
+	// 连续失败多少次判定为不健康，连续成功多少次恢复
+	FailureThreshold int `toml:"failure_threshold"`
+	SuccessThreshold int `toml:"success_threshold"`
+	// 除了获取 VQD token，再发送一条很短的对话
+	ChatProbe      bool   `toml:"chat_probe"`
+	ChatProbeModel string `toml:"chat_probe_model"`
+}
+
+func defaultHealthConfig() HealthConfig {
+	return HealthConfig{
+		Enabled:          true,
+		Interval:         time.Minute,
+		Timeout:          15 * time.Second,
+		FailureThreshold: 3,
+		SuccessThreshold: 1,
+		ChatProbeModel:   "ddg/gpt-4o-mini",
+	}
+}
+
+// HealthStatus is the cached result of the upstream checks, served by /health.
+type HealthStatus struct {
+	Healthy              bool      `json:"healthy"`
+	Draining             bool      `json:"draining"`
+	CheckEnabled         bool      `json:"check_enabled"`
+	LastCheck            time.Time `json:"last_check"`
+	LastSuccess          time.Time `json:"last_success"`
+	LastError            string    `json:"last_error,omitempty"`
+	ConsecutiveFailures  int       `json:"consecutive_failures"`
+	ConsecutiveSuccesses int       `json:"consecutive_successes"`
+	VQDLatencyMs         int64     `json:"vqd_latency_ms"`
+	ChatLatencyMs        int64     `json:"chat_latency_ms,omitempty"`
+	// 出口代理的状态，没有配置代理时为空
+	Proxies []ProxyStatus `json:"proxies,omitempty"`
+	// 模型发现的状态，未启用时为空
+	ModelDiscovery *DiscoveryStatus `json:"model_discovery,omitempty"`
+}
+
+type healthChecker struct {
+	mu     sync.RWMutex
+	status HealthStatus
+}
+
+// 全局的上游健康状态
+var upstreamHealth = &healthChecker{}
+
+func (h *healthChecker) snapshot() HealthStatus {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.status
+}
+
+// ready reports whether traffic should be routed to this instance.
+func (h *healthChecker) ready(config *Config) bool {
+	if inflight.isDraining() {
+		return false
+	}
+	if !config.Health.Enabled {
+		return true
+	}
+	return h.snapshot().Healthy
+}
+
+// run checks the upstream immediately and then every Interval until ctx is
+// cancelled.
+func (h *healthChecker) run(ctx context.Context, store *ConfigStore) {
+	for {
+		config := store.Get()
+		interval := config.Health.Interval
+		if config.Health.Enabled {
+			h.check(ctx, config)
+		} else {
+			// 检查关闭时定期确认配置是否重新开启
+			interval = 10 * time.Second
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (h *healthChecker) check(ctx context.Context, config *Config) {
+	ctx, cancel := context.WithTimeout(ctx, config.Health.Timeout)
+	defer cancel()
+
+	result := make(chan HealthStatus, 1)
+	go func() {
+		result <- probeUpstream(ctx, config)
+	}()
+
+	var probe HealthStatus
+	select {
+	case probe = <-result:
+	case <-ctx.Done():
+		probe.LastError = fmt.Sprintf("health check timed out after %s", config.Health.Timeout)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	wasHealthy := h.status.Healthy
+	h.status.LastCheck = time.Now()
+	h.status.VQDLatencyMs = probe.VQDLatencyMs
+	h.status.ChatLatencyMs = probe.ChatLatencyMs
+	h.status.LastError = probe.LastError
+
+	if probe.LastError == "" {
+		h.status.LastSuccess = h.status.LastCheck
+		h.status.ConsecutiveFailures = 0
+		h.status.ConsecutiveSuccesses++
+		if h.status.ConsecutiveSuccesses >= config.Health.SuccessThreshold {
+			h.status.Healthy = true
+		}
+	} else {
+		h.status.ConsecutiveSuccesses = 0
+		h.status.ConsecutiveFailures++
+		if h.status.ConsecutiveFailures >= config.Health.FailureThreshold {
+			h.status.Healthy = false
+		}
+		logger.Warn("upstream health check failed", zap.String("error", probe.LastError), zap.Int("consecutive_failures", h.status.ConsecutiveFailures))
+	}
+
+	if wasHealthy != h.status.Healthy {
+		logger.Info("upstream health changed", zap.Bool("healthy", h.status.Healthy))
+	}
+}
+
+// probeUpstream fetches a VQD token and, if configured, runs a tiny chat.
+func probeUpstream(ctx context.Context, config *Config) HealthStatus {
+	var probe HealthStatus
+
+	start := time.Now()
+	if _, err := updateVQDToken(ctx, egressProxies.pick(config), fingerprints.pick(config), config); err != nil {
+		probe.LastError = fmt.Sprintf("vqd: %v", err)
+		return probe
+	}
+	probe.VQDLatencyMs = time.Since(start).Milliseconds()
+
+	if !config.Health.ChatProbe {
+		return probe
+	}
+
+	start = time.Now()
+	channel := make(chan string)
+	go func() {
+		for range channel {
+		}
+	}()
+	history := []ChatMessage{{Role: "user", Content: "ping"}}
+	err := chatWithDuckDuckGo(ctx, "ping", config.Health.ChatProbeModel, history, channel, config)
+	close(channel)
+	if err != nil {
+		probe.LastError = fmt.Sprintf("chat: %v", err)
+		return probe
+	}
+	probe.ChatLatencyMs = time.Since(start).Milliseconds()
+
+	return probe
+}
+
+// HealthHandler serves the detailed upstream health. It responds with 503
+// while the instance is not ready.
+func HealthHandler(store *ConfigStore) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		config := store.Get()
+		status := upstreamHealth.snapshot()
+		status.Draining = inflight.isDraining()
+		status.CheckEnabled = config.Health.Enabled
+		status.Proxies = egressProxies.statuses()
+		status.ModelDiscovery = upstreamModels.snapshot(config)
+		if !config.Health.Enabled {
+			status.Healthy = true
+		}
+
+		if !upstreamHealth.ready(config) {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(status)
+		}
+		return c.JSON(status)
+	}
+}
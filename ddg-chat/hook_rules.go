@@ -0,0 +1,293 @@
+package ddgchat
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+// 规则作用的阶段和动作
+const (
+	hookStageRequest  = "request"
+	hookStageResponse = "response"
+
+	hookActionReplace = "replace"
+	hookActionPrepend = "prepend"
+	hookActionAppend  = "append"
+	hookActionBlock   = "block"
+)
+
+var (
+	hookStages  = []string{hookStageRequest, hookStageResponse}
+	hookActions = []string{hookActionReplace, hookActionPrepend, hookActionAppend, hookActionBlock}
+	hookRoles   = []string{"system", "user", "assistant"}
+)
+
+type HooksConfig struct {
+	// 流式回复中留到后续 chunk 再处理的字符数，更长的 response 匹配可能漏掉
+	StreamHoldback int `toml:"stream_holdback"`
+	// 按顺序执行
+	Rules []HookRule `toml:"rules"`
+}
+
+// HookRule rewrites or blocks requests or replies.
+type HookRule struct {
+	// request 作用于发往上游的消息，response 作用于回复
+	Stage string `toml:"stage"`
+	// replace、prepend、append 或 block
+	Action string `toml:"action"`
+	// 正则表达式，replace 和 block 使用
+	Pattern string `toml:"pattern"`
+	// replace 的替换内容，可以用 $1 引用分组
+	Replacement string `toml:"replacement"`
+	// prepend 和 append 添加的内容
+	Text string `toml:"text"`
+	// request 规则作用的消息角色，prepend 和 append 默认为 system，replace 和 block 默认为全部
+	Role string `toml:"role"`
+	// block 拒绝请求时返回的信息
+	Message string `toml:"message"`
+}
+
+func defaultHooksConfig() HooksConfig {
+	return HooksConfig{
+		StreamHoldback: 256,
+	}
+}
+
+func validateHooksConfig(config HooksConfig) []ConfigProblem {
+	var problems []ConfigProblem
+	if config.StreamHoldback < 0 {
+		problems = append(problems, ConfigProblem{Key: "hooks.stream_holdback", Message: "must not be negative"})
+	}
+
+	for i, rule := range config.Rules {
+		prefix := fmt.Sprintf("rule #%d: ", i+1)
+		if !slices.Contains(hookStages, rule.Stage) {
+			problems = append(problems, ConfigProblem{Key: "hooks.rules", Message: prefix + fmt.Sprintf("unknown stage %q, use one of %s", rule.Stage, strings.Join(hookStages, ", "))})
+		}
+		switch rule.Action {
+		case hookActionReplace, hookActionBlock:
+			if rule.Pattern == "" {
+				problems = append(problems, ConfigProblem{Key: "hooks.rules", Message: prefix + rule.Action + " needs a pattern"})
+			} else if _, err := regexp.Compile(rule.Pattern); err != nil {
+				problems = append(problems, ConfigProblem{Key: "hooks.rules", Message: prefix + fmt.Sprintf("invalid pattern: %v", err)})
+			}
+		case hookActionPrepend, hookActionAppend:
+			if rule.Text == "" {
+				problems = append(problems, ConfigProblem{Key: "hooks.rules", Message: prefix + rule.Action + " needs a text"})
+			}
+		default:
+			problems = append(problems, ConfigProblem{Key: "hooks.rules", Message: prefix + fmt.Sprintf("unknown action %q, use one of %s", rule.Action, strings.Join(hookActions, ", "))})
+		}
+		if rule.Role != "" && (rule.Stage != hookStageRequest || !slices.Contains(hookRoles, rule.Role)) {
+			problems = append(problems, ConfigProblem{Key: "hooks.rules", Message: prefix + fmt.Sprintf("role %q is only allowed for request rules and must be one of %s", rule.Role, strings.Join(hookRoles, ", "))})
+		}
+	}
+	return problems
+}
+
+type compiledRule struct {
+	HookRule
+	re *regexp.Regexp
+}
+
+// matchesRole reports whether a request rule applies to messages of role.
+func (r compiledRule) matchesRole(role string) bool {
+	return r.Role == "" || r.Role == role
+}
+
+// blockedError is returned by block rules.
+type blockedError struct {
+	message string
+}
+
+func (e *blockedError) Error() string {
+	return e.message
+}
+
+func (e *blockedError) Unwrap() error {
+	return ErrBlocked
+}
+
+func (r compiledRule) blocked() error {
+	if r.Message == "" {
+		return ErrBlocked
+	}
+	return &blockedError{message: r.Message}
+}
+
+// rulesHook is the Hook built from the rules of [hooks].
+type rulesHook struct {
+	NopHook
+	request  []compiledRule
+	response []compiledRule
+	holdback int
+}
+
+func (h *rulesHook) PreRequest(ctx context.Context, req *ChatCompletionRequest) error {
+	if len(h.request) == 0 {
+		return nil
+	}
+	// 不修改调用方的消息
+	req.Messages = slices.Clone(req.Messages)
+
+	for _, rule := range h.request {
+		switch rule.Action {
+		case hookActionReplace:
+			for i, msg := range req.Messages {
+				if rule.matchesRole(msg.Role) {
+					req.Messages[i].Content = rule.re.ReplaceAllString(msg.Content, rule.Replacement)
+				}
+			}
+		case hookActionBlock:
+			for _, msg := range req.Messages {
+				if rule.matchesRole(msg.Role) && rule.re.MatchString(msg.Content) {
+					loggerFromContext(ctx).Info("request blocked by hook rule", zap.String("pattern", rule.Pattern))
+					return rule.blocked()
+				}
+			}
+		case hookActionPrepend, hookActionAppend:
+			role := rule.Role
+			if role == "" {
+				role = "system"
+			}
+			// 修改最后一条该角色的消息，没有时在开头插入一条
+			last := -1
+			for i, msg := range req.Messages {
+				if msg.Role == role {
+					last = i
+				}
+			}
+			if last < 0 {
+				req.Messages = slices.Insert(req.Messages, 0, ChatMessage{Role: role, Content: rule.Text})
+				continue
+			}
+			// 继续的对话中已经添加过的内容不再重复添加
+			content := req.Messages[last].Content
+			if rule.Action == hookActionPrepend && !strings.HasPrefix(content, rule.Text) {
+				req.Messages[last].Content = rule.Text + content
+			}
+			if rule.Action == hookActionAppend && !strings.HasSuffix(content, rule.Text) {
+				req.Messages[last].Content = content + rule.Text
+			}
+		}
+	}
+	return nil
+}
+
+func (h *rulesHook) TransformChunks(ctx context.Context, req *ChatCompletionRequest) ChunkTransformer {
+	if len(h.response) == 0 {
+		return nil
+	}
+	return &rulesTransformer{ctx: ctx, rules: h.response, holdback: h.holdback}
+}
+
+// rulesTransformer applies the response rules to a reply. It holds back the
+// last holdback bytes, and any match reaching into them, so that matches
+// across chunk boundaries are replaced as a whole.
+type rulesTransformer struct {
+	ctx      context.Context
+	rules    []compiledRule
+	holdback int
+	pending  string
+	started  bool
+}
+
+func (t *rulesTransformer) Transform(chunk string) (string, error) {
+	t.pending += chunk
+	cut := len(t.pending) - t.holdback
+	if cut <= 0 {
+		return "", nil
+	}
+
+	// 跨过 cut 的匹配整个留到下一次
+	for moved := true; moved; {
+		moved = false
+		for _, rule := range t.rules {
+			if rule.re == nil {
+				continue
+			}
+			for _, loc := range rule.re.FindAllStringIndex(t.pending, -1) {
+				if loc[0] < cut && loc[1] > cut {
+					cut = loc[0]
+					moved = true
+				}
+			}
+		}
+	}
+	for cut > 0 && !utf8.RuneStart(t.pending[cut]) {
+		cut--
+	}
+	return t.release(cut, false)
+}
+
+func (t *rulesTransformer) Flush() (string, error) {
+	return t.release(len(t.pending), true)
+}
+
+// release applies the rules to the first n bytes of the pending text and
+// returns them.
+func (t *rulesTransformer) release(n int, final bool) (string, error) {
+	text := t.pending[:n]
+	t.pending = t.pending[n:]
+	if text == "" && !final {
+		return "", nil
+	}
+
+	var prefix, suffix string
+	for _, rule := range t.rules {
+		switch rule.Action {
+		case hookActionBlock:
+			if rule.re.MatchString(text) {
+				loggerFromContext(t.ctx).Info("reply blocked by hook rule", zap.String("pattern", rule.Pattern))
+				return "", rule.blocked()
+			}
+		case hookActionReplace:
+			text = rule.re.ReplaceAllString(text, rule.Replacement)
+		case hookActionPrepend:
+			prefix += rule.Text
+		case hookActionAppend:
+			suffix += rule.Text
+		}
+	}
+
+	if !t.started {
+		t.started = true
+		text = prefix + text
+	}
+	if final {
+		text += suffix
+	}
+	return text, nil
+}
+
+// compileHookRules builds the rules hook of config, nil without rules.
+func compileHookRules(config HooksConfig) *rulesHook {
+	if len(config.Rules) == 0 {
+		return nil
+	}
+
+	hook := &rulesHook{holdback: config.StreamHoldback}
+	for _, rule := range config.Rules {
+		compiled := compiledRule{HookRule: rule}
+		if rule.Action == hookActionReplace || rule.Action == hookActionBlock {
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil || rule.Pattern == "" {
+				// 无效的规则已被配置检查拒绝，这里跳过
+				continue
+			}
+			compiled.re = re
+		}
+		if rule.Stage == hookStageRequest {
+			hook.request = append(hook.request, compiled)
+		} else {
+			hook.response = append(hook.response, compiled)
+		}
+	}
+	return hook
+}
@@ -0,0 +1,165 @@
+package ddgchat
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Hook customizes chat completions without changing the handlers. Hooks
+// run in registration order, after the content policy and the rules of
+// [hooks]. Embed NopHook to implement only some of the methods.
+type Hook interface {
+	// PreRequest may change the request, including its model, before the
+	// model is resolved. An error wrapping ErrBlocked rejects the request
+	// with 400 content_filter, other errors with 500.
+	PreRequest(ctx context.Context, req *ChatCompletionRequest) error
+	// TransformChunks returns the transformer for the reply to req, or nil
+	// to leave the reply unchanged.
+	TransformChunks(ctx context.Context, req *ChatCompletionRequest) ChunkTransformer
+	// PostResponse may change the full reply. For streams the client has
+	// already received the chunks, the result is what is stored in the
+	// conversation, the cache and the audit log.
+	PostResponse(ctx context.Context, req *ChatCompletionRequest, text string) (string, error)
+}
+
+// ChunkTransformer rewrites the chunks of one reply. Non-streaming replies
+// are passed as a single chunk. An error wrapping ErrBlocked ends the reply
+// with finish_reason content_filter.
+type ChunkTransformer interface {
+	// Transform returns the text to send for chunk, it may hold part of it
+	// back until later chunks arrive.
+	Transform(chunk string) (string, error)
+	// Flush returns the text still held back when the reply ends.
+	Flush() (string, error)
+}
+
+// ErrBlocked is wrapped by hook errors that block a request or a reply.
+var ErrBlocked = errors.New("blocked by content policy")
+
+// NopHook implements Hook without changing anything.
+type NopHook struct{}
+
+func (NopHook) PreRequest(context.Context, *ChatCompletionRequest) error {
+	return nil
+}
+
+func (NopHook) TransformChunks(context.Context, *ChatCompletionRequest) ChunkTransformer {
+	return nil
+}
+
+func (NopHook) PostResponse(_ context.Context, _ *ChatCompletionRequest, text string) (string, error) {
+	return text, nil
+}
+
+var (
+	hooksMutex      sync.RWMutex
+	registeredHooks []Hook
+)
+
+// RegisterHook adds a hook to every chat completion. Register hooks before
+// starting the server.
+func RegisterHook(hook Hook) {
+	hooksMutex.Lock()
+	defer hooksMutex.Unlock()
+	registeredHooks = append(registeredHooks, hook)
+}
+
+// activeHooks returns the content policy and the rules of config followed
+// by the registered hooks.
+func activeHooks(config *Config) []Hook {
+	var hooks []Hook
+	state := config.state()
+	if set := state.policies; set != nil {
+		hooks = append(hooks, &policyHook{set: set, lookBehind: config.ContentPolicy.LookBehind})
+	}
+	if rules := state.hooks; rules != nil {
+		hooks = append(hooks, rules)
+	}
+	hooksMutex.RLock()
+	defer hooksMutex.RUnlock()
+	return append(hooks, registeredHooks...)
+}
+
+// runPreRequest runs the PreRequest hooks on req.
+func runPreRequest(ctx context.Context, config *Config, req *ChatCompletionRequest) *requestError {
+	for _, hook := range activeHooks(config) {
+		if err := hook.PreRequest(ctx, req); err != nil {
+			if errors.Is(err, ErrBlocked) {
+				return newRequestError(fiber.StatusBadRequest, "content_filter", "messages", err.Error())
+			}
+			return &requestError{status: fiber.StatusInternalServerError, response: newErrorResponse("server_error", "hook_failed", err.Error())}
+		}
+	}
+	return nil
+}
+
+// runPostResponse runs the PostResponse hooks on the reply to req.
+func runPostResponse(ctx context.Context, config *Config, req *ChatCompletionRequest, text string) (string, error) {
+	for _, hook := range activeHooks(config) {
+		var err error
+		if text, err = hook.PostResponse(ctx, req, text); err != nil {
+			return "", err
+		}
+	}
+	return text, nil
+}
+
+// replyTransformer chains the chunk transformers of all hooks.
+type replyTransformer struct {
+	transformers []ChunkTransformer
+}
+
+func newReplyTransformer(ctx context.Context, config *Config, req *ChatCompletionRequest) *replyTransformer {
+	r := &replyTransformer{}
+	for _, hook := range activeHooks(config) {
+		if t := hook.TransformChunks(ctx, req); t != nil {
+			r.transformers = append(r.transformers, t)
+		}
+	}
+	return r
+}
+
+func (r *replyTransformer) transform(chunk string) (string, error) {
+	for _, t := range r.transformers {
+		var err error
+		if chunk, err = t.Transform(chunk); err != nil {
+			return "", err
+		}
+	}
+	return chunk, nil
+}
+
+func (r *replyTransformer) flush() (string, error) {
+	// 前面的 transformer 剩下的内容还要经过后面的 transformer
+	text := ""
+	for _, t := range r.transformers {
+		transformed, err := t.Transform(text)
+		if err != nil {
+			return "", err
+		}
+		rest, err := t.Flush()
+		if err != nil {
+			return "", err
+		}
+		text = transformed + rest
+	}
+	return text, nil
+}
+
+// transformReply runs a whole non-streaming reply through the transformers
+// and the PostResponse hooks.
+func transformReply(ctx context.Context, config *Config, req *ChatCompletionRequest, text string) (string, error) {
+	r := newReplyTransformer(ctx, config, req)
+	transformed, err := r.transform(text)
+	if err != nil {
+		return "", err
+	}
+	rest, err := r.flush()
+	if err != nil {
+		return "", err
+	}
+	return runPostResponse(ctx, config, req, transformed+rest)
+}
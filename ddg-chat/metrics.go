@@ -0,0 +1,198 @@
+package ddgchat
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type MetricsConfig struct {
+	Enabled bool `toml:"enabled"`
+	// 修改后需要重启才能生效
+	Path string `toml:"path"`
+}
+
+func defaultMetricsConfig() MetricsConfig {
+	return MetricsConfig{
+		Enabled: true,
+		Path:    "/metrics",
+	}
+}
+
+const metricsNamespace = "ddg_chat"
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "API requests by route, model, token name and status code.",
+	}, []string{"route", "model", "token", "status"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_duration_seconds",
+		Help:      "API request latency, for streams until the last event is sent.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120},
+	}, []string{"route", "model", "token"})
+
+	streamTimeToFirstToken = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "stream_time_to_first_token_seconds",
+		Help:      "Time from request start until the first content chunk of a stream.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2, 3, 5, 10, 20, 30},
+	}, []string{"model"})
+
+	streamTokensPerSecond = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "stream_tokens_per_second",
+		Help:      "Estimated completion tokens per second of finished streams.",
+		Buckets:   []float64{1, 2, 5, 10, 20, 50, 100, 200},
+	}, []string{"model"})
+
+	upstreamResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_responses_total",
+		Help:      "Responses from the DuckDuckGo chat endpoint by status code.",
+	}, []string{"status"})
+
+	vqdFetchFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "vqd_fetch_failures_total",
+		Help:      "Failed attempts to fetch a VQD token.",
+	})
+
+	discoveryFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "model_discovery_failures_total",
+		Help:      "Failed attempts to fetch the upstream model list.",
+	})
+
+	proxyEjections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "proxy_ejections_total",
+		Help:      "Egress proxies taken out of rotation after repeated failures.",
+	}, []string{"proxy"})
+
+	upstreamRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_retries_total",
+		Help:      "Chat requests retried after being rate limited.",
+	})
+
+	modelFallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "model_fallbacks_total",
+		Help:      "Chat requests retried with a fallback model, by requested and fallback model.",
+	}, []string{"model", "fallback"})
+
+	contextDroppedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "context_dropped_messages_total",
+		Help:      "Messages dropped from requests to fit the context window of their model.",
+	}, []string{"model"})
+
+	summarizations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "summarizations_total",
+		Help:      "Rolling summarizations of stored conversations, by result.",
+	}, []string{"result"})
+
+	contentFilteredTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "content_filtered_total",
+		Help:      "Requests and replies blocked by the content policy, by direction and category.",
+	}, []string{"direction", "category"})
+
+	redactedValues = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "redacted_values_total",
+		Help:      "Values replaced with placeholders in upstream requests, by detector.",
+	}, []string{"detector"})
+
+	coalescedRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "coalesced_requests_total",
+		Help:      "Chat requests that joined an identical in-flight upstream request.",
+	})
+
+	queuedRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "queued_requests",
+		Help:      "Requests waiting in the queue for an upstream slot.",
+	})
+
+	queueWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_wait_seconds",
+		Help:      "Time queued requests waited for an upstream slot.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120},
+	})
+
+	queueRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_rejections_total",
+		Help:      "Requests rejected by the queue, because it was full or the wait timed out.",
+	}, []string{"reason"})
+
+	activeStreams = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "active_streams",
+		Help:      "Streaming completions currently in progress.",
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "conversations_stored",
+		Help:      "Conversations held in memory.",
+	}, func() float64 {
+		conversationMutex.RLock()
+		defer conversationMutex.RUnlock()
+		return float64(len(conversations))
+	})
+)
+
+// MetricsHandler serves the Prometheus metrics.
+func MetricsHandler() func(c *fiber.Ctx) error {
+	return adaptor.HTTPHandler(promhttp.Handler())
+}
+
+// MetricsMiddleware records count and latency of every request. Streaming
+// completions set "stream" in Locals and are recorded when the stream ends.
+func MetricsMiddleware() func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+
+		if stream, _ := c.Locals("stream").(bool); stream {
+			return err
+		}
+
+		status := c.Response().StatusCode()
+		if fiberErr, ok := err.(*fiber.Error); ok {
+			status = fiberErr.Code
+		}
+		observeRequest(c.Route().Path, localString(c, "model"), localString(c, "token_name"), status, start)
+		return err
+	}
+}
+
+func observeRequest(route string, model string, tokenName string, status int, start time.Time) {
+	requestsTotal.WithLabelValues(route, model, tokenName, strconv.Itoa(status)).Inc()
+	requestDuration.WithLabelValues(route, model, tokenName).Observe(time.Since(start).Seconds())
+}
+
+func localString(c *fiber.Ctx, key string) string {
+	value, _ := c.Locals(key).(string)
+	return value
+}
+
+// estimateTokens 用简单的空格分词估算 token 数量
+func estimateTokens(text string) int {
+	return len(strings.Split(text, " "))
+}
@@ -0,0 +1,218 @@
+package ddgchat
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ModelEntry is the value of a model_mapping entry. It is written either as
+// the DuckDuckGo model name or as a table:
+//
+//	"ddg/gpt-4o-mini" = { model = "gpt-4o-mini", fallbacks = ["ddg/claude-3-haiku"] }
+//
+// Metadata left empty is taken from the built-in catalog of the DuckDuckGo
+// model, see modelInfo.
+type ModelEntry struct {
+	// DuckDuckGo 的模型名
+	Model string `toml:"model"`
+	// 也可以用这些名称请求这个模型
+	Aliases []string `toml:"aliases"`
+	// 失败时按顺序尝试的其他模型，使用 model_mapping 中的名称
+	Fallbacks []string `toml:"fallbacks"`
+	// 哪些错误会换下一个模型，为空时使用 defaultFallbackOn
+	FallbackOn []string `toml:"fallback_on"`
+
+	// 以下是 /v1/models 返回的信息
+	DisplayName     string `toml:"display_name"`
+	OwnedBy         string `toml:"owned_by"`
+	ContextWindow   int    `toml:"context_window"`
+	MaxOutputTokens int    `toml:"max_output_tokens"`
+	// streaming、tools、json_mode
+	Capabilities []string `toml:"capabilities"`
+	// 固定的创建时间，/v1/models 中的 created
+	Created time.Time `toml:"created"`
+}
+
+// UnmarshalTOML accepts a plain model name or a table.
+func (e *ModelEntry) UnmarshalTOML(data interface{}) error {
+	switch value := data.(type) {
+	case string:
+		*e = ModelEntry{Model: value}
+		return nil
+	case map[string]interface{}:
+		var entry ModelEntry
+		for key, item := range value {
+			var err error
+			switch key {
+			case "model":
+				entry.Model, err = tomlString(key, item)
+			case "aliases":
+				entry.Aliases, err = tomlStrings(key, item)
+			case "fallbacks":
+				entry.Fallbacks, err = tomlStrings(key, item)
+			case "fallback_on":
+				entry.FallbackOn, err = tomlStrings(key, item)
+			case "display_name":
+				entry.DisplayName, err = tomlString(key, item)
+			case "owned_by":
+				entry.OwnedBy, err = tomlString(key, item)
+			case "context_window":
+				entry.ContextWindow, err = tomlInt(key, item)
+			case "max_output_tokens":
+				entry.MaxOutputTokens, err = tomlInt(key, item)
+			case "capabilities":
+				entry.Capabilities, err = tomlStrings(key, item)
+			case "created":
+				entry.Created, err = tomlTime(key, item)
+			default:
+				err = fmt.Errorf("unknown key %q in model_mapping entry", key)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		*e = entry
+		return nil
+	}
+	return fmt.Errorf("model_mapping entry must be a model name or a table, got %T", data)
+}
+
+// UnmarshalText sets only the model name, it is used by the
+// DDG_CHAT_MODEL_MAPPING and --model-mapping overrides.
+func (e *ModelEntry) UnmarshalText(text []byte) error {
+	*e = ModelEntry{Model: string(text)}
+	return nil
+}
+
+// MarshalTOML writes the short form when only the model is set, so that
+// "config show" prints the mapping as it is usually written.
+func (e ModelEntry) MarshalTOML() ([]byte, error) {
+	model, _ := json.Marshal(e.Model)
+	if reflect.DeepEqual(e, ModelEntry{Model: e.Model}) {
+		return model, nil
+	}
+
+	// JSON 的字符串、数字和数组同时也是合法的 TOML，created 写成字符串
+	fields := []string{"model = " + string(model)}
+	add := func(key string, value interface{}, empty bool) {
+		if empty {
+			return
+		}
+		data, _ := json.Marshal(value)
+		fields = append(fields, key+" = "+string(data))
+	}
+	add("aliases", e.Aliases, len(e.Aliases) == 0)
+	add("fallbacks", e.Fallbacks, len(e.Fallbacks) == 0)
+	add("fallback_on", e.FallbackOn, len(e.FallbackOn) == 0)
+	add("display_name", e.DisplayName, e.DisplayName == "")
+	add("owned_by", e.OwnedBy, e.OwnedBy == "")
+	add("context_window", e.ContextWindow, e.ContextWindow == 0)
+	add("max_output_tokens", e.MaxOutputTokens, e.MaxOutputTokens == 0)
+	add("capabilities", e.Capabilities, len(e.Capabilities) == 0)
+	add("created", e.Created.Format(time.RFC3339), e.Created.IsZero())
+	return []byte("{ " + strings.Join(fields, ", ") + " }"), nil
+}
+
+func (e ModelEntry) String() string {
+	if len(e.Fallbacks) == 0 {
+		return e.Model
+	}
+	return fmt.Sprintf("%s (fallbacks: %s)", e.Model, strings.Join(e.Fallbacks, ", "))
+}
+
+func tomlString(key string, value interface{}) (string, error) {
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%s must be a string", key)
+	}
+	return s, nil
+}
+
+func tomlInt(key string, value interface{}) (int, error) {
+	n, ok := value.(int64)
+	if !ok {
+		return 0, fmt.Errorf("%s must be an integer", key)
+	}
+	return int(n), nil
+}
+
+// tomlTime accepts a TOML date or datetime, or the same as a string.
+func tomlTime(key string, value interface{}) (time.Time, error) {
+	switch value := value.(type) {
+	case time.Time:
+		return value, nil
+	case string:
+		for _, layout := range []string{time.RFC3339, time.DateOnly} {
+			if t, err := time.Parse(layout, value); err == nil {
+				return t, nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("%s must be a date, e.g. 2024-07-18", key)
+}
+
+func tomlStrings(key string, value interface{}) ([]string, error) {
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be a list of strings", key)
+	}
+	values := make([]string, 0, len(items))
+	for _, item := range items {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s must be a list of strings", key)
+		}
+		values = append(values, s)
+	}
+	return values, nil
+}
+
+func validateModelMapping(mapping map[string]ModelEntry) []ConfigProblem {
+	var problems []ConfigProblem
+
+	models := make([]string, 0, len(mapping))
+	for model := range mapping {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+
+	for _, model := range models {
+		entry := mapping[model]
+		key := "model_mapping." + model
+		seen := map[string]bool{model: true}
+		for _, fallback := range entry.Fallbacks {
+			switch {
+			case fallback == model:
+				problems = append(problems, ConfigProblem{Key: key, Message: "a model cannot be its own fallback"})
+			case seen[fallback]:
+				problems = append(problems, ConfigProblem{Key: key, Message: fmt.Sprintf("fallback %s is listed twice", fallback)})
+			case mapping[fallback].Model == "":
+				problems = append(problems, ConfigProblem{Key: key, Message: fmt.Sprintf("fallback %s is not in model_mapping", fallback)})
+			}
+			seen[fallback] = true
+		}
+		for _, class := range entry.FallbackOn {
+			if !slices.Contains(upstreamErrorClasses, class) {
+				problems = append(problems, ConfigProblem{Key: key, Message: fmt.Sprintf("unknown error class %q in fallback_on, use one of %s", class, strings.Join(upstreamErrorClasses, ", "))})
+			}
+		}
+
+		for _, capability := range entry.Capabilities {
+			if !slices.Contains(modelCapabilities, capability) {
+				problems = append(problems, ConfigProblem{Key: key, Message: fmt.Sprintf("unknown capability %q, use one of %s", capability, strings.Join(modelCapabilities, ", "))})
+			}
+		}
+		if entry.ContextWindow < 0 || entry.MaxOutputTokens < 0 {
+			problems = append(problems, ConfigProblem{Key: key, Message: "context_window and max_output_tokens must not be negative"})
+		}
+		if entry.ContextWindow > 0 && entry.MaxOutputTokens > entry.ContextWindow {
+			problems = append(problems, ConfigProblem{Key: key, Message: "max_output_tokens must not exceed context_window"})
+		}
+	}
+	return problems
+}
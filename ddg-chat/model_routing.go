@@ -0,0 +1,145 @@
+package ddgchat
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type ModelRoutingConfig struct {
+	// 没有匹配到任何模型时使用的 model_mapping 名称，为空时返回 404
+	DefaultModel string `toml:"default_model"`
+	// 按顺序匹配，在 model_mapping 的名称和别名之后检查
+	Patterns []ModelPattern `toml:"patterns"`
+}
+
+// ModelPattern routes requested model names matching Glob or Regex to a
+// model_mapping entry.
+type ModelPattern struct {
+	// * 匹配任意字符（包括 /），? 匹配单个字符
+	Glob  string `toml:"glob"`
+	Regex string `toml:"regex"`
+	Model string `toml:"model"`
+}
+
+func defaultModelRoutingConfig() ModelRoutingConfig {
+	return ModelRoutingConfig{}
+}
+
+func validateModelRoutingConfig(config ModelRoutingConfig, mapping map[string]ModelEntry) []ConfigProblem {
+	var problems []ConfigProblem
+
+	if config.DefaultModel != "" {
+		if _, ok := mapping[config.DefaultModel]; !ok {
+			problems = append(problems, ConfigProblem{Key: "model_routing.default_model", Message: fmt.Sprintf("model %s is not in model_mapping", config.DefaultModel)})
+		}
+	}
+
+	for i, pattern := range config.Patterns {
+		prefix := fmt.Sprintf("pattern #%d: ", i+1)
+		if (pattern.Glob == "") == (pattern.Regex == "") {
+			problems = append(problems, ConfigProblem{Key: "model_routing.patterns", Message: prefix + "set exactly one of glob and regex"})
+		} else if _, err := pattern.compile(); err != nil {
+			problems = append(problems, ConfigProblem{Key: "model_routing.patterns", Message: prefix + err.Error()})
+		}
+		if _, ok := mapping[pattern.Model]; !ok {
+			problems = append(problems, ConfigProblem{Key: "model_routing.patterns", Message: prefix + fmt.Sprintf("model %q is not in model_mapping", pattern.Model)})
+		}
+	}
+
+	// 别名不能与模型名或其他别名重复
+	models := make([]string, 0, len(mapping))
+	for model := range mapping {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+	owners := make(map[string]string)
+	for _, model := range models {
+		for _, alias := range mapping[model].Aliases {
+			key := "model_mapping." + model
+			switch {
+			case alias == "":
+				problems = append(problems, ConfigProblem{Key: key, Message: "aliases must not be empty"})
+			case mapping[alias].Model != "" || alias == model:
+				problems = append(problems, ConfigProblem{Key: key, Message: fmt.Sprintf("alias %s is also a model name", alias)})
+			case owners[alias] != "":
+				problems = append(problems, ConfigProblem{Key: key, Message: fmt.Sprintf("alias %s is already used by %s", alias, owners[alias])})
+			default:
+				owners[alias] = model
+			}
+		}
+	}
+	return problems
+}
+
+func (p ModelPattern) compile() (*regexp.Regexp, error) {
+	if p.Regex != "" {
+		re, err := regexp.Compile(p.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %v", err)
+		}
+		return re, nil
+	}
+
+	expr := regexp.QuoteMeta(p.Glob)
+	expr = strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(expr)
+	return regexp.Compile("^" + expr + "$")
+}
+
+// compileModelRoutes compiles the patterns of config, in order. Invalid
+// patterns are nil.
+func compileModelRoutes(config ModelRoutingConfig) []*regexp.Regexp {
+	patterns := make([]*regexp.Regexp, len(config.Patterns))
+	for i, pattern := range config.Patterns {
+		// 无效的规则已被配置检查拒绝，这里跳过
+		if re, err := pattern.compile(); err == nil {
+			patterns[i] = re
+		}
+	}
+	return patterns
+}
+
+// resolveModel maps a requested model name to a model_mapping entry: the
+// name itself, an alias, the first matching pattern and, if useDefault is
+// set, the default model.
+func resolveModel(config *Config, name string, useDefault bool) (string, bool) {
+	mapping := modelMapping(config)
+	if _, ok := mapping[name]; ok {
+		return name, true
+	}
+
+	models := make([]string, 0, len(mapping))
+	for model := range mapping {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+	for _, model := range models {
+		for _, alias := range mapping[model].Aliases {
+			if alias == name {
+				return model, true
+			}
+		}
+	}
+
+	for i, re := range config.state().routes {
+		if re != nil && re.MatchString(name) {
+			if model := config.ModelRouting.Patterns[i].Model; mapping[model].Model != "" {
+				return model, true
+			}
+		}
+	}
+
+	if useDefault && config.ModelRouting.DefaultModel != "" {
+		if _, ok := mapping[config.ModelRouting.DefaultModel]; ok {
+			return config.ModelRouting.DefaultModel, true
+		}
+	}
+	return "", false
+}
+
+func modelNotFound(name string) *requestError {
+	return newRequestError(fiber.StatusNotFound, "model_not_found", "model", fmt.Sprintf("the model %s does not exist", name))
+}
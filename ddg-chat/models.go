@@ -1,5 +1,7 @@
 package ddgchat
 
+import "encoding/json"
+
 // 常量定义
 var DEFAULT_MODEL_MAPPING = map[string]string{
 	"ddg/gpt-4o-mini":                       "gpt-4o-mini",
@@ -10,10 +12,17 @@ var DEFAULT_MODEL_MAPPING = map[string]string{
 
 // 模型结构体定义
 type ModelInfo struct {
-	ID      string `json:"id"`
-	Object  string `json:"object"`
-	Created int64  `json:"created"`
-	OwnedBy string `json:"owned_by"`
+	ID              string   `json:"id"`
+	Object          string   `json:"object"`
+	Created         int64    `json:"created"`
+	OwnedBy         string   `json:"owned_by"`
+	DisplayName     string   `json:"display_name"`
+	ContextWindow   int      `json:"context_window,omitempty"`
+	MaxOutputTokens int      `json:"max_output_tokens,omitempty"`
+	Capabilities    []string `json:"capabilities"`
+	Aliases         []string `json:"aliases,omitempty"`
+	// 启用模型发现时，上游不再提供的模型为 false
+	Available bool `json:"available"`
 }
 
 type ChatMessage struct {
@@ -34,6 +43,13 @@ type ChatCompletionRequest struct {
 	FreqPenalty     *float64           `json:"frequency_penalty,omitempty"`
 	LogitBias       map[string]float64 `json:"logit_bias,omitempty"`
 	User            *string            `json:"user,omitempty"`
+	// 只用于检查模型是否支持，不会发给上游
+	Tools          []json.RawMessage `json:"tools,omitempty"`
+	ResponseFormat *ResponseFormat   `json:"response_format,omitempty"`
+}
+
+type ResponseFormat struct {
+	Type string `json:"type"`
 }
 
 type ChatCompletionResponseChoice struct {
@@ -75,3 +91,43 @@ type ChatCompletionStreamResponse struct {
 	Model   string                               `json:"model"`
 	Choices []ChatCompletionStreamResponseChoice `json:"choices"`
 }
+
+// OpenAI 风格的错误结构
+type APIError struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+func newErrorResponse(errType string, code string, message string) ErrorResponse {
+	return ErrorResponse{
+		Error: APIError{
+			Message: message,
+			Type:    errType,
+			Code:    &code,
+		},
+	}
+}
+
+type ModerationRequest struct {
+	// 字符串或字符串数组
+	Input json.RawMessage `json:"input"`
+	Model string          `json:"model,omitempty"`
+}
+
+type ModerationResult struct {
+	Flagged        bool               `json:"flagged"`
+	Categories     map[string]bool    `json:"categories"`
+	CategoryScores map[string]float64 `json:"category_scores"`
+}
+
+type ModerationResponse struct {
+	ID      string             `json:"id"`
+	Model   string             `json:"model"`
+	Results []ModerationResult `json:"results"`
+}
@@ -0,0 +1,277 @@
+package ddgchat
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// 所有环境变量覆盖都使用这个前缀
+const EnvPrefix = "DDG_CHAT_"
+
+var (
+	durationType        = reflect.TypeOf(time.Duration(0))
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	tomlUnmarshalerType = reflect.TypeOf((*toml.Unmarshaler)(nil)).Elem()
+)
+
+// ConfigField is a config key that can be overridden from the environment
+// or the command line.
+type ConfigField struct {
+	Key   string // dotted toml key, e.g. "port"
+	Env   string // environment variable, e.g. "DDG_CHAT_PORT"
+	Flag  string // command line flag, e.g. "port"
+	Type  string // value type shown in usage
+	index []int
+}
+
+// ConfigFields lists every config key. Nested tables are flattened with "."
+// in Key and "-" in Flag, lists and maps of tables take a TOML value.
+func ConfigFields() []ConfigField {
+	var fields []ConfigField
+	collectConfigFields(reflect.TypeOf(Config{}), "", nil, &fields)
+	return fields
+}
+
+func collectConfigFields(t reflect.Type, prefix string, index []int, fields *[]ConfigField) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("toml"), ",")[0]
+		if !field.IsExported() || name == "" || name == "-" {
+			continue
+		}
+
+		key := name
+		if prefix != "" {
+			key = prefix + "." + name
+		}
+		fieldIndex := append(append([]int{}, index...), i)
+
+		if field.Type.Kind() == reflect.Struct && !reflect.PointerTo(field.Type).Implements(textUnmarshalerType) {
+			collectConfigFields(field.Type, key, fieldIndex, fields)
+			continue
+		}
+
+		typeName := configValueType(field.Type)
+		if typeName == "" {
+			continue
+		}
+
+		env := field.Tag.Get("env")
+		if env == "" {
+			env = EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+		}
+
+		*fields = append(*fields, ConfigField{
+			Key:   key,
+			Env:   env,
+			Flag:  strings.NewReplacer(".", "-", "_", "-").Replace(key),
+			Type:  typeName,
+			index: fieldIndex,
+		})
+	}
+}
+
+func configValueType(t reflect.Type) string {
+	if reflect.PointerTo(t).Implements(textUnmarshalerType) {
+		return "string"
+	}
+	if t == durationType {
+		return "duration"
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "bool"
+	case reflect.Int, reflect.Int64:
+		return "int"
+	case reflect.Float64:
+		return "float"
+	case reflect.Slice:
+		if configValueType(t.Elem()) == "string" {
+			return "strings"
+		}
+		if t.Elem().Kind() == reflect.Struct {
+			return "toml"
+		}
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return ""
+		}
+		if configValueType(t.Elem()) == "string" {
+			return "stringToString"
+		}
+		if t.Elem().Kind() == reflect.Struct {
+			return "toml"
+		}
+	}
+	return ""
+}
+
+// Set parses value and stores it in the field of config. Lists are comma
+// separated and maps are written as "key=value,key2=value2". Fields of type
+// "toml" take a TOML array or inline table, string maps accept one as well:
+//
+//	[{ stage = "request", action = "prepend", text = "Be brief." }]
+func (f ConfigField) Set(config *Config, value string) error {
+	target := reflect.ValueOf(config).Elem().FieldByIndex(f.index)
+	var err error
+	if f.Type == "toml" || f.Type == "stringToString" && strings.HasPrefix(strings.TrimSpace(value), "{") {
+		err = setTOMLValue(target, value)
+	} else {
+		err = setConfigValue(target, value)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value for %s: %w", f.Key, err)
+	}
+	return nil
+}
+
+func setConfigValue(target reflect.Value, value string) error {
+	if target.CanAddr() && target.Addr().Type().Implements(textUnmarshalerType) {
+		return target.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(value))
+	}
+	if target.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		target.SetInt(int64(d))
+		return nil
+	}
+
+	switch target.Kind() {
+	case reflect.String:
+		target.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		target.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		target.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		target.SetFloat(n)
+	case reflect.Slice:
+		items := splitList(value)
+		slice := reflect.MakeSlice(target.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setConfigValue(slice.Index(i), item); err != nil {
+				return err
+			}
+		}
+		target.Set(slice)
+	case reflect.Map:
+		m := reflect.MakeMap(target.Type())
+		for _, item := range splitList(value) {
+			k, v, ok := strings.Cut(item, "=")
+			if !ok {
+				return fmt.Errorf("expected key=value, got %q", item)
+			}
+			elem := reflect.New(target.Type().Elem()).Elem()
+			if err := setConfigValue(elem, strings.TrimSpace(v)); err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(strings.TrimSpace(k)), elem)
+		}
+		target.Set(m)
+	default:
+		return fmt.Errorf("unsupported type %s", target.Type())
+	}
+	return nil
+}
+
+// setTOMLValue decodes value as the TOML value of target.
+func setTOMLValue(target reflect.Value, value string) error {
+	wrapper := reflect.New(reflect.StructOf([]reflect.StructField{
+		{Name: "Value", Type: target.Type(), Tag: `toml:"value"`},
+	}))
+	md, err := toml.Decode("value = "+value, wrapper.Interface())
+	if err != nil {
+		return err
+	}
+	for _, key := range md.Undecoded() {
+		if !decodedByUnmarshaler(target.Type(), key[1:]) {
+			return fmt.Errorf("unknown key %s", strings.Join(key[1:], "."))
+		}
+	}
+	target.Set(wrapper.Elem().Field(0))
+	return nil
+}
+
+// decodedByUnmarshaler reports whether key lies inside a value that decodes
+// itself with UnmarshalTOML, the toml decoder lists those keys as undecoded.
+func decodedByUnmarshaler(t reflect.Type, key []string) bool {
+	for _, part := range key {
+		for t.Kind() == reflect.Slice || t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		if reflect.PointerTo(t).Implements(tomlUnmarshalerType) {
+			return true
+		}
+		switch t.Kind() {
+		case reflect.Map:
+			t = t.Elem()
+		case reflect.Struct:
+			field, ok := tomlField(t, part)
+			if !ok {
+				return false
+			}
+			t = field.Type
+		default:
+			return false
+		}
+	}
+	return reflect.PointerTo(t).Implements(tomlUnmarshalerType)
+}
+
+func tomlField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.IsExported() && strings.Split(field.Tag.Get("toml"), ",")[0] == name {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// ApplyEnvOverrides overrides config fields from DDG_CHAT_* variables.
+// lookup is usually os.LookupEnv.
+func ApplyEnvOverrides(config *Config, lookup func(string) (string, bool)) error {
+	for _, field := range ConfigFields() {
+		value, ok := lookup(field.Env)
+		if !ok {
+			continue
+		}
+		if err := field.Set(config, value); err != nil {
+			return fmt.Errorf("%s: %w", field.Env, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package ddgchat
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+type QueueConfig struct {
+	Enabled bool `toml:"enabled"`
+	// 同时进行的上游请求数
+	MaxConcurrency int `toml:"max_concurrency"`
+	// 最多排队的请求数，超出时直接返回 429
+	MaxQueue int           `toml:"max_queue"`
+	Timeout  time.Duration `toml:"timeout"`
+	// 流式请求排队时发送队列位置的间隔
+	PositionInterval time.Duration `toml:"position_interval"`
+	// 按 token 名称划分的优先级，其余为普通优先级
+	HighPriorityTokens []string `toml:"high_priority_tokens"`
+	LowPriorityTokens  []string `toml:"low_priority_tokens"`
+}
+
+func defaultQueueConfig() QueueConfig {
+	return QueueConfig{
+		MaxConcurrency:   4,
+		MaxQueue:         100,
+		Timeout:          time.Minute,
+		PositionInterval: 2 * time.Second,
+	}
+}
+
+func validateQueueConfig(config QueueConfig) []ConfigProblem {
+	var problems []ConfigProblem
+	if !config.Enabled {
+		return nil
+	}
+
+	if config.MaxConcurrency < 1 {
+		problems = append(problems, ConfigProblem{Key: "queue.max_concurrency", Message: "must be at least 1"})
+	}
+	if config.MaxQueue < 0 {
+		problems = append(problems, ConfigProblem{Key: "queue.max_queue", Message: "must not be negative"})
+	}
+	if config.Timeout <= 0 {
+		problems = append(problems, ConfigProblem{Key: "queue.timeout", Message: fmt.Sprintf("invalid timeout: %s", config.Timeout)})
+	}
+	if config.PositionInterval <= 0 {
+		problems = append(problems, ConfigProblem{Key: "queue.position_interval", Message: fmt.Sprintf("invalid interval: %s", config.PositionInterval)})
+	}
+	for _, name := range config.HighPriorityTokens {
+		if slices.Contains(config.LowPriorityTokens, name) {
+			problems = append(problems, ConfigProblem{Key: "queue.low_priority_tokens", Message: fmt.Sprintf("token %q is also listed in high_priority_tokens", name)})
+		}
+	}
+	return problems
+}
+
+var (
+	errQueueFull    = errors.New("too many requests are queued, try again later")
+	errQueueTimeout = errors.New("timed out waiting in the request queue")
+)
+
+// queueErrorResponse is the OpenAI style error for errQueueFull and
+// errQueueTimeout, sent with status 429.
+func queueErrorResponse(err error) ErrorResponse {
+	code := "queue_full"
+	if errors.Is(err, errQueueTimeout) {
+		code = "queue_timeout"
+	}
+	return newErrorResponse("rate_limit_error", code, err.Error())
+}
+
+// queueWaiter is a request waiting for an upstream slot. Higher priority
+// goes first, equal priorities in arrival order.
+type queueWaiter struct {
+	priority int
+	seq      uint64
+	index    int
+	granted  bool
+	ready    chan struct{}
+}
+
+type waiterHeap []*queueWaiter
+
+func (h waiterHeap) Len() int { return len(h) }
+
+func (h waiterHeap) Less(i, j int) bool {
+	return h[i].before(h[j])
+}
+
+func (h waiterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *waiterHeap) Push(x any) {
+	w := x.(*queueWaiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+
+func (h *waiterHeap) Pop() any {
+	old := *h
+	w := old[len(old)-1]
+	*h = old[:len(old)-1]
+	w.index = -1
+	return w
+}
+
+func (w *queueWaiter) before(other *queueWaiter) bool {
+	if w.priority != other.priority {
+		return w.priority > other.priority
+	}
+	return w.seq < other.seq
+}
+
+// requestQueue limits concurrent upstream calls and queues the rest by
+// priority.
+type requestQueue struct {
+	mu      sync.Mutex
+	max     int
+	active  int
+	seq     uint64
+	waiters waiterHeap
+}
+
+// 全局上游请求队列
+var upstreamQueue = &requestQueue{}
+
+func queuePriority(config QueueConfig, tokenName string) int {
+	switch {
+	case slices.Contains(config.HighPriorityTokens, tokenName):
+		return 1
+	case slices.Contains(config.LowPriorityTokens, tokenName):
+		return -1
+	}
+	return 0
+}
+
+// acquire waits for an upstream slot. While waiting, onPosition is called
+// with the 1-based queue position every position_interval. The returned
+// release function must be called when the upstream call is done.
+func (q *requestQueue) acquire(ctx context.Context, config QueueConfig, tokenName string, onPosition func(position int)) (func(), error) {
+	if !config.Enabled {
+		return func() {}, nil
+	}
+
+	q.mu.Lock()
+	// 配置可能已经热更新
+	q.max = config.MaxConcurrency
+	q.dispatch()
+	if q.active < q.max && len(q.waiters) == 0 {
+		q.active++
+		q.mu.Unlock()
+		return q.release, nil
+	}
+	if len(q.waiters) >= config.MaxQueue {
+		q.mu.Unlock()
+		queueRejections.WithLabelValues("full").Inc()
+		return nil, errQueueFull
+	}
+
+	q.seq++
+	w := &queueWaiter{
+		priority: queuePriority(config, tokenName),
+		seq:      q.seq,
+		ready:    make(chan struct{}),
+	}
+	heap.Push(&q.waiters, w)
+	queuedRequests.Inc()
+	q.mu.Unlock()
+
+	start := time.Now()
+	defer func() {
+		queuedRequests.Dec()
+		queueWait.Observe(time.Since(start).Seconds())
+	}()
+
+	timeout := time.NewTimer(config.Timeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(config.PositionInterval)
+	defer ticker.Stop()
+
+	if position := q.position(w); position > 0 {
+		onPosition(position)
+	}
+	for {
+		select {
+		case <-w.ready:
+			return q.release, nil
+		case <-ticker.C:
+			if position := q.position(w); position > 0 {
+				onPosition(position)
+			}
+		case <-timeout.C:
+			q.abandon(w)
+			queueRejections.WithLabelValues("timeout").Inc()
+			return nil, errQueueTimeout
+		case <-ctx.Done():
+			q.abandon(w)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (q *requestQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.active--
+	q.dispatch()
+}
+
+// dispatch hands free slots to the waiters in priority order, q.mu must
+// be held.
+func (q *requestQueue) dispatch() {
+	for q.active < q.max && len(q.waiters) > 0 {
+		w := heap.Pop(&q.waiters).(*queueWaiter)
+		w.granted = true
+		q.active++
+		close(w.ready)
+	}
+}
+
+// abandon removes a waiter that gave up. A slot granted in the meantime is
+// given back.
+func (q *requestQueue) abandon(w *queueWaiter) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if w.granted {
+		q.active--
+		q.dispatch()
+		return
+	}
+	heap.Remove(&q.waiters, w.index)
+}
+
+// position returns how many waiters are ahead of w plus one, or 0 once w
+// got its slot.
+func (q *requestQueue) position(w *queueWaiter) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if w.granted {
+		return 0
+	}
+	position := 1
+	for _, other := range q.waiters {
+		if other.before(w) {
+			position++
+		}
+	}
+	return position
+}
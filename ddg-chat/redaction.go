@@ -0,0 +1,263 @@
+package ddgchat
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+
+	"go.uber.org/zap"
+)
+
+// 可以检测的个人信息
+const (
+	detectorEmail  = "email"
+	detectorPhone  = "phone"
+	detectorAPIKey = "api_key"
+	detectorIP     = "ip"
+)
+
+type RedactionConfig struct {
+	// 发给上游之前把消息中的个人信息换成占位符，回复中再换回原来的内容
+	Enabled bool `toml:"enabled"`
+	// email、phone、api_key、ip
+	Detectors []string `toml:"detectors"`
+	// 只对这些 token 生效，为空时对所有 token 生效
+	Tokens []string `toml:"tokens"`
+	// 不做脱敏的 token
+	ExcludeTokens []string `toml:"exclude_tokens"`
+}
+
+func defaultRedactionConfig() RedactionConfig {
+	return RedactionConfig{
+		Detectors: []string{detectorEmail, detectorPhone, detectorAPIKey, detectorIP},
+	}
+}
+
+func validateRedactionConfig(config RedactionConfig) []ConfigProblem {
+	if !config.Enabled {
+		return nil
+	}
+
+	var problems []ConfigProblem
+	if len(config.Detectors) == 0 {
+		problems = append(problems, ConfigProblem{Key: "redaction.detectors", Message: "at least one detector is required"})
+	}
+	for _, name := range config.Detectors {
+		if !slices.ContainsFunc(piiDetectors, func(d piiDetector) bool { return d.name == name }) {
+			problems = append(problems, ConfigProblem{Key: "redaction.detectors", Message: fmt.Sprintf("unknown detector %q, use one of %s", name, strings.Join(piiDetectorNames(), ", "))})
+		}
+	}
+	for _, token := range config.ExcludeTokens {
+		if slices.Contains(config.Tokens, token) {
+			problems = append(problems, ConfigProblem{Key: "redaction.exclude_tokens", Message: fmt.Sprintf("token %s is also in tokens", token)})
+		}
+	}
+	return problems
+}
+
+// piiDetector finds one kind of personal data. If the expression has a
+// matching group only the group is replaced, valid filters out false
+// positives.
+type piiDetector struct {
+	name        string
+	placeholder string
+	re          *regexp.Regexp
+	valid       func(value string) bool
+}
+
+// 按顺序检测，API key 可能包含像电话号码的数字，所以最先检测
+var piiDetectors = []piiDetector{
+	{
+		name:        detectorAPIKey,
+		placeholder: "API_KEY",
+		re: regexp.MustCompile(`\b(?:sk-(?:proj-|ant-)?[A-Za-z0-9_-]{20,}|gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,}|AKIA[0-9A-Z]{16}|AIza[0-9A-Za-z_-]{35}|xox[abposr]-[A-Za-z0-9-]{10,}|glpat-[A-Za-z0-9_-]{20,})` +
+			`|(?i:\b(?:api[_-]?key|access[_-]?token|secret[_-]?key|secret|token|password)\b["']?\s*[:=]\s*["']?([A-Za-z0-9_\-./+]{16,}))`),
+	},
+	{
+		name:        detectorEmail,
+		placeholder: "EMAIL",
+		re:          regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`),
+	},
+	{
+		name:        detectorIP,
+		placeholder: "IP",
+		// 版本号的前缀 "version"、"v" 和多于四段的数字一起匹配，再由 valid 排除
+		re: regexp.MustCompile(`(?i:\bv(?:ersion)?\s*)?\b(?:\d{1,3}\.){3}\d{1,3}(?:\.\d+)*\b|(?i:\b[0-9a-f]{0,4}(?::[0-9a-f]{0,4}){2,7}(?:%[0-9a-z]+)?)`),
+		valid: func(value string) bool {
+			host, _, _ := strings.Cut(value, "%")
+			// IPv6 至少三组，排除 "std::cout" 和 "::1" 之类
+			if strings.Contains(host, ":") && len(strings.FieldsFunc(host, func(r rune) bool { return r == ':' })) < 3 {
+				return false
+			}
+			return net.ParseIP(host) != nil
+		},
+	},
+	{
+		name:        detectorPhone,
+		placeholder: "PHONE",
+		re:          regexp.MustCompile(`(?:\+\d{1,3}[ .-]?)?(?:\(\d{1,4}\)[ .-]?)?\b\d{2,4}(?:[ .-]?\d{2,4}){1,5}\b`),
+		valid: func(value string) bool {
+			// 日期后面跟着时间时数字够多，但不是电话号码
+			if datePattern.MatchString(value) {
+				return false
+			}
+			// 9 到 15 位数字，排除日期和版本号之类较短的数字
+			digits := 0
+			for _, r := range value {
+				if unicode.IsDigit(r) {
+					digits++
+				}
+			}
+			return digits >= 9 && digits <= 15
+		},
+	},
+}
+
+// 年月日或日月年顺序的日期
+var datePattern = regexp.MustCompile(`\b(?:19|20)\d{2}[-./](?:0?[1-9]|1[0-2])[-./](?:0?[1-9]|[12]\d|3[01])\b|\b(?:0?[1-9]|[12]\d|3[01])[-./](?:0?[1-9]|1[0-2])[-./](?:19|20)\d{2}\b`)
+
+func piiDetectorNames() []string {
+	names := make([]string, len(piiDetectors))
+	for i, d := range piiDetectors {
+		names[i] = d.name
+	}
+	return names
+}
+
+// redactionEnabled reports whether the requests of tokenName are redacted.
+func redactionEnabled(config RedactionConfig, tokenName string) bool {
+	if !config.Enabled || slices.Contains(config.ExcludeTokens, tokenName) {
+		return false
+	}
+	return len(config.Tokens) == 0 || slices.Contains(config.Tokens, tokenName)
+}
+
+// redactor replaces personal data with placeholders numbered in order of
+// appearance, so the same history always gets the same placeholders.
+type redactor struct {
+	detectors    []piiDetector
+	placeholders map[string]string
+	originals    map[string]string
+	counts       map[string]int
+}
+
+func newRedactor(config RedactionConfig) *redactor {
+	r := &redactor{
+		placeholders: make(map[string]string),
+		originals:    make(map[string]string),
+		counts:       make(map[string]int),
+	}
+	for _, d := range piiDetectors {
+		if slices.Contains(config.Detectors, d.name) {
+			r.detectors = append(r.detectors, d)
+		}
+	}
+	return r
+}
+
+func (r *redactor) redact(text string) string {
+	for _, d := range r.detectors {
+		var b strings.Builder
+		last := 0
+		for _, loc := range d.re.FindAllStringSubmatchIndex(text, -1) {
+			start, end := loc[0], loc[1]
+			if len(loc) > 2 && loc[2] >= 0 {
+				// 只替换值，保留 "api_key=" 之类的前缀
+				start, end = loc[2], loc[3]
+			}
+			value := text[start:end]
+			if d.valid != nil && !d.valid(value) {
+				continue
+			}
+			b.WriteString(text[last:start])
+			b.WriteString(r.placeholder(d, value))
+			last = end
+		}
+		b.WriteString(text[last:])
+		text = b.String()
+	}
+	return text
+}
+
+func (r *redactor) placeholder(d piiDetector, value string) string {
+	if placeholder, ok := r.placeholders[value]; ok {
+		return placeholder
+	}
+	r.counts[d.placeholder]++
+	placeholder := fmt.Sprintf("[%s_%d]", d.placeholder, r.counts[d.placeholder])
+	r.placeholders[value] = placeholder
+	r.originals[placeholder] = value
+	redactedValues.WithLabelValues(d.name).Inc()
+	return placeholder
+}
+
+// 可能是被拆开的占位符的结尾，例如 "[EMA" 或 "[EMAIL_1"
+var partialPlaceholder = regexp.MustCompile(`\[[A-Z_]*[0-9]*$`)
+
+// restoreReply copies chunks to channel with the placeholders replaced by
+// the original values. A placeholder split across chunks is held back until
+// it is complete.
+func (r *redactor) restoreReply(ctx context.Context, chunks <-chan string, channel chan<- string) {
+	pairs := make([]string, 0, 2*len(r.originals))
+	for placeholder, original := range r.originals {
+		pairs = append(pairs, placeholder, original)
+	}
+	replacer := strings.NewReplacer(pairs...)
+
+	send := func(text string) {
+		if text == "" {
+			return
+		}
+		// 请求取消后继续读取 chunks，让上游请求能够退出
+		select {
+		case channel <- replacer.Replace(text):
+		case <-ctx.Done():
+		}
+	}
+
+	pending := ""
+	for chunk := range chunks {
+		text := pending + chunk
+		pending = ""
+		if loc := partialPlaceholder.FindStringIndex(text); loc != nil {
+			text, pending = text[:loc[0]], text[loc[0]:]
+		}
+		send(text)
+	}
+	send(pending)
+}
+
+// redactChat returns the history to send upstream for the token of ctx,
+// the channel the reply should be sent to and a function to call once the
+// last chunk was sent. Chunks sent to that channel reach channel with the
+// placeholders replaced by the original values.
+func redactChat(ctx context.Context, config *Config, history []ChatMessage, channel chan string) ([]ChatMessage, chan string, func()) {
+	if !redactionEnabled(config.Redaction, requestInfoFromContext(ctx).getTokenName()) {
+		return history, channel, func() {}
+	}
+
+	r := newRedactor(config.Redaction)
+	redacted := make([]ChatMessage, len(history))
+	for i, msg := range history {
+		redacted[i] = ChatMessage{Role: msg.Role, Content: r.redact(msg.Content)}
+	}
+	if len(r.originals) == 0 {
+		return history, channel, func() {}
+	}
+	loggerFromContext(ctx).Debug("redacted messages", zap.Int("values", len(r.originals)))
+
+	chunks := make(chan string)
+	restored := make(chan struct{})
+	go func() {
+		defer close(restored)
+		r.restoreReply(ctx, chunks, channel)
+	}()
+	return redacted, chunks, func() {
+		close(chunks)
+		<-restored
+	}
+}
@@ -0,0 +1,186 @@
+package ddgchat
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// 模型能力，用于 model_mapping 的 capabilities
+const (
+	capabilityStreaming = "streaming"
+	capabilityTools     = "tools"
+	capabilityJSONMode  = "json_mode"
+)
+
+var modelCapabilities = []string{capabilityStreaming, capabilityTools, capabilityJSONMode}
+
+// 没有配置也不在内置目录中的模型只支持流式输出
+var defaultCapabilities = []string{capabilityStreaming}
+
+// builtinModels describes the DuckDuckGo models, keyed by upstream model
+// name. It fills in what model_mapping entries leave empty.
+var builtinModels = map[string]ModelEntry{
+	"gpt-4o-mini": {
+		DisplayName:     "GPT-4o mini",
+		OwnedBy:         "openai",
+		ContextWindow:   128000,
+		MaxOutputTokens: 16384,
+		Capabilities:    []string{capabilityStreaming},
+		Created:         time.Date(2024, time.July, 18, 0, 0, 0, 0, time.UTC),
+	},
+	"claude-3-haiku-20240307": {
+		DisplayName:     "Claude 3 Haiku",
+		OwnedBy:         "anthropic",
+		ContextWindow:   200000,
+		MaxOutputTokens: 4096,
+		Capabilities:    []string{capabilityStreaming},
+		Created:         time.Date(2024, time.March, 7, 0, 0, 0, 0, time.UTC),
+	},
+	"mistralai/Mixtral-8x7B-Instruct-v0.1": {
+		DisplayName:     "Mixtral 8x7B Instruct",
+		OwnedBy:         "mistralai",
+		ContextWindow:   32768,
+		MaxOutputTokens: 4096,
+		Capabilities:    []string{capabilityStreaming},
+		Created:         time.Date(2023, time.December, 11, 0, 0, 0, 0, time.UTC),
+	},
+	"meta-llama/Meta-Llama-3.1-70B-Instruct-Turbo": {
+		DisplayName:     "Llama 3.1 70B Instruct Turbo",
+		OwnedBy:         "meta-llama",
+		ContextWindow:   128000,
+		MaxOutputTokens: 4096,
+		Capabilities:    []string{capabilityStreaming},
+		Created:         time.Date(2024, time.July, 23, 0, 0, 0, 0, time.UTC),
+	},
+}
+
+// modelMapping returns model_mapping plus the models found by discovery
+// that are not mapped yet.
+func modelMapping(config *Config) map[string]ModelEntry {
+	discovered := upstreamModels.newModels(config)
+	if len(discovered) == 0 {
+		return config.ModelMapping
+	}
+	mapping := make(map[string]ModelEntry, len(config.ModelMapping)+len(discovered))
+	for id, entry := range discovered {
+		mapping[id] = entry
+	}
+	for id, entry := range config.ModelMapping {
+		mapping[id] = entry
+	}
+	return mapping
+}
+
+// modelInfo returns the metadata of a mapped model. Fields left empty in
+// the entry come from builtinModels.
+func modelInfo(config *Config, id string) (ModelInfo, bool) {
+	entry, ok := modelMapping(config)[id]
+	if !ok {
+		return ModelInfo{}, false
+	}
+	builtin := builtinModels[entry.Model]
+
+	info := ModelInfo{
+		ID:              id,
+		Object:          "model",
+		OwnedBy:         firstNonEmpty(entry.OwnedBy, builtin.OwnedBy, "custom"),
+		DisplayName:     firstNonEmpty(entry.DisplayName, builtin.DisplayName, id),
+		ContextWindow:   entry.ContextWindow,
+		MaxOutputTokens: entry.MaxOutputTokens,
+		Capabilities:    entry.Capabilities,
+		Aliases:         entry.Aliases,
+		Available:       upstreamModels.available(config, entry.Model),
+	}
+	if info.ContextWindow == 0 {
+		info.ContextWindow = builtin.ContextWindow
+	}
+	if info.MaxOutputTokens == 0 {
+		info.MaxOutputTokens = builtin.MaxOutputTokens
+	}
+	if info.Capabilities == nil {
+		info.Capabilities = builtin.Capabilities
+	}
+	if info.Capabilities == nil {
+		info.Capabilities = defaultCapabilities
+	}
+	// 未知的创建时间为 0，保证每次返回相同的结果
+	if created := entry.Created; !created.IsZero() {
+		info.Created = created.Unix()
+	} else if !builtin.Created.IsZero() {
+		info.Created = builtin.Created.Unix()
+	}
+	return info, true
+}
+
+// listModels returns every mapped model sorted by ID.
+func listModels(config *Config) []ModelInfo {
+	mapping := modelMapping(config)
+	ids := make([]string, 0, len(mapping))
+	for id := range mapping {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	models := make([]ModelInfo, 0, len(ids))
+	for _, id := range ids {
+		info, _ := modelInfo(config, id)
+		models = append(models, info)
+	}
+	return models
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// requestError is a client error answered in the OpenAI error format.
+type requestError struct {
+	status   int
+	response ErrorResponse
+}
+
+func (e *requestError) Error() string {
+	return e.response.Error.Message
+}
+
+func newRequestError(status int, code string, param string, message string) *requestError {
+	response := newErrorResponse("invalid_request_error", code, message)
+	if param != "" {
+		response.Error.Param = &param
+	}
+	return &requestError{status: status, response: response}
+}
+
+// validateCompletionRequest checks a request against the metadata of its
+// model, req.Model must already be resolved.
+func validateCompletionRequest(config *Config, req ChatCompletionRequest) *requestError {
+	model, ok := modelInfo(config, req.Model)
+	if !ok {
+		return nil
+	}
+
+	if req.Stream && !slices.Contains(model.Capabilities, capabilityStreaming) {
+		return newRequestError(fiber.StatusBadRequest, "unsupported_capability", "stream", fmt.Sprintf("model %s does not support streaming", req.Model))
+	}
+	if len(req.Tools) > 0 && !slices.Contains(model.Capabilities, capabilityTools) {
+		return newRequestError(fiber.StatusBadRequest, "unsupported_capability", "tools", fmt.Sprintf("model %s does not support tools", req.Model))
+	}
+	if req.ResponseFormat != nil && req.ResponseFormat.Type != "" && req.ResponseFormat.Type != "text" && !slices.Contains(model.Capabilities, capabilityJSONMode) {
+		return newRequestError(fiber.StatusBadRequest, "unsupported_capability", "response_format", fmt.Sprintf("model %s does not support JSON mode", req.Model))
+	}
+
+	if req.MaxTokens != nil && model.MaxOutputTokens > 0 && *req.MaxTokens > model.MaxOutputTokens {
+		return newRequestError(fiber.StatusBadRequest, "invalid_value", "max_tokens", fmt.Sprintf("max_tokens is too large: %d, model %s supports at most %d completion tokens", *req.MaxTokens, req.Model, model.MaxOutputTokens))
+	}
+	// 上下文长度由 fitContext 检查
+	return nil
+}
@@ -0,0 +1,303 @@
+package ddgchat
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// 配置文件变化后等待多久再重新加载，避免编辑器多次写入触发多次加载
+const reloadDebounce = 200 * time.Millisecond
+
+// compiledState is what requests need from a config in compiled form. It is
+// built once when a config is published, together with the config, so a
+// request never pairs a config with rules compiled from another one.
+type compiledState struct {
+	hooks    *rulesHook
+	policies *policySet
+	routes   []*regexp.Regexp
+	// fingerprint 的 profile，包括 profiles_file 中的
+	profiles []FingerprintProfile
+}
+
+func compileState(config *Config) *compiledState {
+	return &compiledState{
+		hooks:    compileHookRules(config.Hooks),
+		policies: compilePolicySet(config.ContentPolicy),
+		routes:   compileModelRoutes(config.ModelRouting),
+		profiles: compileFingerprintProfiles(config.Fingerprint),
+	}
+}
+
+// state returns the compiled state of c. Configs that were not published
+// by a ConfigStore, like those of tests and config checks, are compiled on
+// every call.
+func (c *Config) state() *compiledState {
+	if c.compiled != nil {
+		return c.compiled
+	}
+	return compileState(c)
+}
+
+// ConfigStore holds the active config and swaps it atomically on reload.
+// Handlers should call Get once per request and use that snapshot.
+type ConfigStore struct {
+	path    string
+	load    func() (*Config, error)
+	current atomic.Pointer[Config]
+	mu      sync.Mutex
+}
+
+// NewConfigStore creates a store with an initial config. load is called on
+// every reload and must return a fully validated config.
+func NewConfigStore(path string, config *Config, load func() (*Config, error)) *ConfigStore {
+	store := &ConfigStore{path: path, load: load}
+	config.compiled = compileState(config)
+	store.current.Store(config)
+	return store
+}
+
+func (s *ConfigStore) Get() *Config {
+	return s.current.Load()
+}
+
+func (s *ConfigStore) Path() string {
+	return s.path
+}
+
+// Reload re-reads the config. If loading or validation fails the old
+// config stays active.
+func (s *ConfigStore) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	newConfig, err := s.load()
+	if err != nil {
+		logger.Error("failed to reload config, keeping current config", zap.String("config_path", s.path), zap.Error(err))
+		return err
+	}
+
+	oldConfig := s.current.Load()
+	changes := diffConfig(oldConfig, newConfig)
+	// profiles_file 的内容不在配置里，比较加载出的 profile
+	state := compileState(newConfig)
+	if file := newConfig.Fingerprint.ProfilesFile; file != "" && file == oldConfig.Fingerprint.ProfilesFile &&
+		!reflect.DeepEqual(state.profiles, oldConfig.state().profiles) {
+		changes = append(changes, fmt.Sprintf("fingerprint.profiles_file: %s changed", file))
+	}
+	if len(changes) == 0 {
+		logger.Info("config reloaded, nothing changed", zap.String("config_path", s.path))
+		return nil
+	}
+
+	if oldConfig.Host != newConfig.Host || oldConfig.Port != newConfig.Port {
+		logger.Warn("listen address changes only take effect after restart",
+			zap.String("host", newConfig.Host), zap.Int("port", newConfig.Port))
+	}
+
+	newConfig.compiled = state
+	s.current.Store(newConfig)
+	logger.Info("config reloaded", zap.String("config_path", s.path), zap.Strings("changes", changes))
+	return nil
+}
+
+// Watch reloads the config whenever a signal arrives on hup and whenever the
+// config file or the fingerprint profiles file changes, until ctx is
+// cancelled. If the files cannot be watched only hup triggers reloads.
+func (s *ConfigStore) Watch(ctx context.Context, hup <-chan os.Signal) {
+	var watcher *fsnotify.Watcher
+	var events chan fsnotify.Event
+	if s.path != "" {
+		var err error
+		if watcher, err = s.watchFile(); err != nil {
+			logger.Error("config file watcher unavailable, reloading on SIGHUP only", zap.String("config_path", s.path), zap.Error(err))
+		} else {
+			defer watcher.Close()
+			s.watchReferencedFiles(watcher)
+			events = make(chan fsnotify.Event)
+			go forwardWatchEvents(ctx, watcher, events)
+		}
+	}
+
+	reload := func() {
+		s.Reload()
+		// 新配置可能引用了其他文件
+		if watcher != nil {
+			s.watchReferencedFiles(watcher)
+		}
+	}
+	var debounce <-chan time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logger.Info("received SIGHUP, reloading config")
+			reload()
+		case event := <-events:
+			if !s.watches(event.Name) {
+				continue
+			}
+			if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) && !event.Has(fsnotify.Rename) {
+				continue
+			}
+			logger.Debug("config file changed", zap.String("event", event.String()))
+			debounce = time.After(reloadDebounce)
+		case <-debounce:
+			debounce = nil
+			reload()
+		}
+	}
+}
+
+// watchedFiles returns the config file and the files it refers to.
+func (s *ConfigStore) watchedFiles() []string {
+	files := []string{s.path}
+	if file := s.Get().Fingerprint.ProfilesFile; file != "" {
+		files = append(files, file)
+	}
+	return files
+}
+
+// watches reports whether a change of name concerns a watched file, or the
+// ..data link Kubernetes swaps in a watched directory.
+func (s *ConfigStore) watches(name string) bool {
+	for _, file := range s.watchedFiles() {
+		if filepath.Dir(name) != filepath.Dir(file) {
+			continue
+		}
+		if base := filepath.Base(name); base == filepath.Base(file) || base == "..data" {
+			return true
+		}
+	}
+	return false
+}
+
+// watchReferencedFiles adds the directories of the files the current config
+// refers to. Directories that are already watched are kept.
+func (s *ConfigStore) watchReferencedFiles(watcher *fsnotify.Watcher) {
+	for _, file := range s.watchedFiles()[1:] {
+		if err := watcher.Add(filepath.Dir(file)); err != nil {
+			logger.Warn("file watcher unavailable, reload on SIGHUP after changing it", zap.String("path", file), zap.Error(err))
+		}
+	}
+}
+
+// watchFile watches the directory of the config file.
+func (s *ConfigStore) watchFile() (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create config watcher: %w", err)
+	}
+	// 监听目录而不是文件本身，这样编辑器的原子替换和 k8s configmap 的软链接切换也能被捕获
+	if err := watcher.Add(filepath.Dir(s.path)); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch config directory: %w", err)
+	}
+	return watcher, nil
+}
+
+func forwardWatchEvents(ctx context.Context, watcher *fsnotify.Watcher, events chan<- fsnotify.Event) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Error("config watcher error", zap.Error(err))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// diffConfig describes the differences between two configs, one entry per
+// changed key. Values of fields tagged secret are never printed.
+func diffConfig(oldConfig, newConfig *Config) []string {
+	var changes []string
+	diffValue("", reflect.ValueOf(*oldConfig), reflect.ValueOf(*newConfig), false, &changes)
+	return changes
+}
+
+func diffValue(path string, oldValue, newValue reflect.Value, secret bool, changes *[]string) {
+	switch oldValue.Kind() {
+	case reflect.Struct:
+		for i := 0; i < oldValue.NumField(); i++ {
+			field := oldValue.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name := strings.Split(field.Tag.Get("toml"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			if path != "" {
+				name = path + "." + name
+			}
+			diffValue(name, oldValue.Field(i), newValue.Field(i), field.Tag.Get("secret") == "true", changes)
+		}
+	case reflect.Map:
+		keys := make(map[string]reflect.Value)
+		for _, key := range oldValue.MapKeys() {
+			keys[fmt.Sprint(key.Interface())] = key
+		}
+		for _, key := range newValue.MapKeys() {
+			keys[fmt.Sprint(key.Interface())] = key
+		}
+		names := make([]string, 0, len(keys))
+		for name := range keys {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			oldItem := oldValue.MapIndex(keys[name])
+			newItem := newValue.MapIndex(keys[name])
+			keyPath := fmt.Sprintf("%s[%q]", path, name)
+			switch {
+			case !oldItem.IsValid():
+				*changes = append(*changes, fmt.Sprintf("%s added: %s", keyPath, formatConfigValue(newItem, secret)))
+			case !newItem.IsValid():
+				*changes = append(*changes, fmt.Sprintf("%s removed", keyPath))
+			case !reflect.DeepEqual(oldItem.Interface(), newItem.Interface()):
+				*changes = append(*changes, fmt.Sprintf("%s: %s -> %s", keyPath, formatConfigValue(oldItem, secret), formatConfigValue(newItem, secret)))
+			}
+		}
+	default:
+		if reflect.DeepEqual(oldValue.Interface(), newValue.Interface()) {
+			return
+		}
+		*changes = append(*changes, fmt.Sprintf("%s: %s -> %s", path, formatConfigValue(oldValue, secret), formatConfigValue(newValue, secret)))
+	}
+}
+
+func formatConfigValue(value reflect.Value, secret bool) string {
+	if secret {
+		if value.Kind() == reflect.Slice {
+			return fmt.Sprintf("<%d redacted>", value.Len())
+		}
+		return "<redacted>"
+	}
+	return fmt.Sprintf("%v", value.Interface())
+}
@@ -0,0 +1,44 @@
+package ddgchat
+
+import "testing"
+
+func TestReloadPublishesCompiledState(t *testing.T) {
+	routed := func(glob string, words ...string) *Config {
+		config := DefaultConfig()
+		config.ModelRouting.Patterns = []ModelPattern{{Glob: glob, Model: "ddg/gpt-4o-mini"}}
+		config.ContentPolicy.Enabled = true
+		config.ContentPolicy.Groups = map[string]PolicyGroup{
+			"default": {Categories: map[string]PolicyList{"banned": {Keywords: words}}},
+		}
+		config.ContentPolicy.DefaultGroup = "default"
+		return config
+	}
+	next := routed("gpt-*", "foo")
+	store := NewConfigStore("", next, func() (*Config, error) { return next, nil })
+
+	config := store.Get()
+	if _, ok := resolveModel(config, "gpt-x", false); !ok {
+		t.Fatal("gpt-x not routed by the initial config")
+	}
+	if !outputFlagged(config, "", "foo") {
+		t.Fatal("foo not flagged by the initial config")
+	}
+
+	next = routed("claude-*", "bar")
+	if err := store.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	config = store.Get()
+	if config.compiled == nil {
+		t.Fatal("reloaded config was published without its compiled state")
+	}
+	if _, ok := resolveModel(config, "gpt-x", false); ok {
+		t.Error("gpt-x still routed after the reload")
+	}
+	if _, ok := resolveModel(config, "claude-x", false); !ok {
+		t.Error("claude-x not routed after the reload")
+	}
+	if outputFlagged(config, "", "foo") || !outputFlagged(config, "", "bar") {
+		t.Error("content policy not replaced by the reload")
+	}
+}
@@ -0,0 +1,83 @@
+package ddgchat
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+// RequestLogMiddleware assigns every request an ID, taken from X-Request-Id
+// when the client sends a usable one, returns it in the response header and
+// writes one summary line per request. Streaming completions write their
+// summary when the stream ends.
+func RequestLogMiddleware() func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+
+		requestID := c.Get(requestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = generateUUID()
+		}
+		c.Set(requestIDHeader, requestID)
+
+		info := newRequestInfo(requestID)
+		c.SetUserContext(withRequestInfo(c.UserContext(), info))
+
+		err := c.Next()
+
+		if stream, _ := c.Locals("stream").(bool); stream {
+			return err
+		}
+
+		status := c.Response().StatusCode()
+		if fiberErr, ok := err.(*fiber.Error); ok {
+			status = fiberErr.Code
+		}
+		logRequestSummary(info, c.Method(), c.Route().Path, status, start, localString(c, "model"), false)
+		return err
+	}
+}
+
+// validRequestID accepts short printable IDs so clients cannot inject
+// arbitrary data into logs and headers.
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > 128 {
+		return false
+	}
+	for _, r := range requestID {
+		if r < '!' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// logRequestSummary writes the single summary line of a request. Chat
+// completions also report model, token usage and upstream retries.
+func logRequestSummary(info *requestInfo, method string, route string, status int, start time.Time, model string, stream bool) {
+	fields := []zap.Field{
+		zap.String("method", method),
+		zap.String("route", route),
+		zap.Int("status", status),
+		zap.Duration("duration", time.Since(start)),
+	}
+
+	if model != "" {
+		fields = append(fields,
+			zap.String("model", model),
+			zap.Bool("stream", stream),
+			zap.Int64("prompt_tokens", info.promptTokens.Load()),
+			zap.Int64("completion_tokens", info.completionTokens.Load()),
+			zap.Int64("retries", info.retries.Load()),
+		)
+	}
+
+	if err := info.getError(); err != nil {
+		info.logger().Error("request failed", append(fields, zap.Error(err))...)
+		return
+	}
+	info.logger().Info("request completed", fields...)
+}
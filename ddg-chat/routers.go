@@ -2,94 +2,222 @@ package ddgchat
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"slices"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"golang.org/x/exp/rand"
 )
 
-func AuthMiddleware(config *Config) func(c *fiber.Ctx) error {
+func AuthMiddleware(store *ConfigStore) func(c *fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
-		if len(config.Tokens) == 0 {
+		config := store.Get()
+		info := requestInfoFromContext(c.UserContext())
+		reqLogger := info.logger()
+		if !config.authEnabled() {
+			c.Locals("token_name", anonymousTokenName)
+			info.setTokenName(anonymousTokenName)
 			return c.Next()
 		}
 
 		// check bearer token
 		authHeader := c.Get("Authorization")
 		if authHeader == "" {
-			logger.Error("no authorization header")
+			reqLogger.Error("no authorization header")
 			return c.SendStatus(fiber.StatusUnauthorized)
 		}
 
 		token := strings.TrimPrefix(authHeader, "Bearer ")
 		if token == "" {
-			logger.Error("no token")
+			reqLogger.Error("no token")
 			return c.SendStatus(fiber.StatusUnauthorized)
 		}
 
-		if !slices.Contains(config.Tokens, token) {
-			logger.Error("invalid token", zap.String("token", token))
+		tokenName, ok := config.tokenName(token)
+		if !ok {
+			reqLogger.Error("invalid token", zap.String("token", token))
 			return c.SendStatus(fiber.StatusUnauthorized)
 		}
 
+		c.Locals("token_name", tokenName)
+		info.setTokenName(tokenName)
 		return c.Next()
 	}
 }
 
-func ListModels(config *Config) func(c *fiber.Ctx) error {
+func ListModels(store *ConfigStore) func(c *fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
-		var models []ModelInfo
-		for model := range config.ModelMapping {
-			models = append(models, ModelInfo{
-				ID:      model,
-				Object:  "model",
-				Created: time.Now().Unix(),
-				OwnedBy: "custom",
-			})
-		}
-
 		return c.JSON(fiber.Map{
-			"data":   models,
+			"data":   listModels(store.Get()),
 			"object": "list",
 		})
 	}
 }
 
-func ChatCompletions(config *Config) func(c *fiber.Ctx) error {
+// GetModel serves one model of /v1/models, also when asked for by an alias
+// or a pattern. IDs contain "/", so the route matches the rest of the path,
+// escaped or not.
+func GetModel(store *ConfigStore) func(c *fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
-		logger.Debug("received chat completions request")
+		id, err := url.PathUnescape(c.Params("+"))
+		if err != nil {
+			id = c.Params("+")
+		}
+		config := store.Get()
+		resolved, ok := resolveModel(config, id, false)
+		if !ok {
+			reqErr := modelNotFound(id)
+			return c.Status(reqErr.status).JSON(reqErr.response)
+		}
+		model, _ := modelInfo(config, resolved)
+		return c.JSON(model)
+	}
+}
+
+func ChatCompletions(store *ConfigStore) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		config := store.Get()
+		info := requestInfoFromContext(c.UserContext())
+		reqLogger := info.logger()
+		reqLogger.Debug("received chat completions request")
 		var req ChatCompletionRequest
 		if err := c.BodyParser(&req); err != nil {
 			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
 		}
 
-		conversationId := generateUUID()
-		logger.Debug("generated conversation id", zap.String("conversation_id", conversationId))
+		// 继续服务端保存的对话，请求只需要包含新的消息
+		conversationId := c.Get("X-Conversation-Id")
+		if conversationId != "" {
+			// 只能继续同一个令牌创建的对话
+			history, ok := ownedConversation(conversationId, info.getTokenName())
+			if !ok {
+				reqErr := newRequestError(fiber.StatusNotFound, "conversation_not_found", "", fmt.Sprintf("the conversation %s does not exist", conversationId))
+				reqLogger.Debug("rejected chat completions request", zap.Error(reqErr))
+				return c.Status(reqErr.status).JSON(reqErr.response)
+			}
+			req.Messages = append(history, req.Messages...)
+			reqLogger.Debug("continuing conversation", zap.String("conversation_id", conversationId), zap.Int("history", len(history)))
+		} else {
+			conversationId = generateUUID()
+			reqLogger.Debug("generated conversation id", zap.String("conversation_id", conversationId))
+		}
+		c.Set("X-Conversation-Id", conversationId)
+
+		// hook 可以修改消息和模型，在解析模型之前执行
+		if reqErr := runPreRequest(c.UserContext(), config, &req); reqErr != nil {
+			reqLogger.Debug("rejected chat completions request", zap.Error(reqErr))
+			return c.Status(reqErr.status).JSON(reqErr.response)
+		}
+
+		// 别名、规则和默认模型都换成 model_mapping 中的名称，未知的模型不会发给上游
+		resolved, ok := resolveModel(config, req.Model, true)
+		if !ok {
+			reqErr := modelNotFound(req.Model)
+			reqLogger.Debug("rejected chat completions request", zap.Error(reqErr))
+			return c.Status(reqErr.status).JSON(reqErr.response)
+		}
+		if resolved != req.Model {
+			reqLogger.Debug("resolved model", zap.String("requested", req.Model), zap.String("model", resolved))
+			req.Model = resolved
+		}
+		c.Locals("model", req.Model)
+
+		if reqErr := validateCompletionRequest(config, req); reqErr != nil {
+			reqLogger.Debug("rejected chat completions request", zap.Error(reqErr))
+			return c.Status(reqErr.status).JSON(reqErr.response)
+		}
+
+		// 历史超出模型的上下文窗口时按 context.policy 删除消息，只影响发给上游的消息，
+		// 保存的对话仍然是完整的历史，之后由摘要处理
+		messages, dropped, reqErr := fitContext(config, req)
+		if reqErr != nil {
+			reqLogger.Debug("rejected chat completions request", zap.Error(reqErr))
+			return c.Status(reqErr.status).JSON(reqErr.response)
+		}
+		if dropped > 0 {
+			reqLogger.Info("dropped messages to fit the context window", zap.Int("dropped", dropped), zap.String("policy", config.Context.Policy))
+			contextDroppedMessages.WithLabelValues(req.Model).Add(float64(dropped))
+		}
+		c.Set("X-Context-Dropped-Messages", strconv.Itoa(dropped))
+
+		if cache := responseCaches.get(config); cache != nil {
+			noCache, noStore := cacheDirectives(c)
+			key := completionCacheKey(config, req)
+			if noCache {
+				c.Set("X-Cache", "BYPASS")
+			} else if entry, ok := cache.get(key); ok && !outputFlagged(config, info.getTokenName(), entry.Response) {
+				// 缓存的回复可能来自策略更宽松的 token，被拦截时按未命中处理
+				c.Set("X-Cache", "HIT")
+				return sendCachedCompletion(c, req, conversationId, entry, config)
+			} else {
+				c.Set("X-Cache", "MISS")
+			}
+			if !noStore {
+				info.cacheKey = key
+			}
+		}
+
+		ctx, done, ok := inflight.begin()
+		if !ok {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(newErrorResponse("server_error", "server_shutdown", errShuttingDown.Error()))
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		// 沿用请求的 trace，取消仍然由 inflight 控制
+		requestSpan := trace.SpanFromContext(c.UserContext())
+		ctx = trace.ContextWithSpan(ctx, requestSpan)
+		ctx = withRequestInfo(ctx, info)
 
 		if req.Stream {
+			c.Locals("stream", true)
+			start := time.Now()
+			route := c.Route().Path
+			tokenName := localString(c, "token_name")
+
 			c.Set("Content-Type", "text/event-stream")
 			c.Set("Cache-Control", "no-cache")
 			c.Set("Connection", "keep-alive")
 			c.Set("Transfer-Encoding", "chunked")
+			// 响应头在流开始前发出，这时还不知道是否会换到备用模型，报告解析后的模型
+			c.Set("X-Model-Used", req.Model)
 
 			channel := make(chan string)
-			go streamResponse(req, conversationId, channel, config)
+			go func() {
+				defer done()
+				streamResponse(ctx, req, messages, conversationId, channel, config)
+			}()
 
 			// 定义一个符合 fasthttp.StreamWriter 类型的函数
 			writer := func(w *bufio.Writer) {
+				defer logRequestSummary(info, fiber.MethodPost, route, fiber.StatusOK, start, req.Model, true)
+				defer observeRequest(route, req.Model, tokenName, fiber.StatusOK, start)
+				defer endRequestSpan(requestSpan, fiber.StatusOK, nil)
+				defer cancel()
+				failed := false
+				// 客户端断开后继续读取 channel，让 streamResponse 能够正常退出
 				for msg := range channel {
+					if failed {
+						continue
+					}
 					if _, err := w.WriteString(msg); err != nil {
-						logger.Error("Error writing to stream", zap.Error(err))
-						return
+						reqLogger.Error("Error writing to stream", zap.Error(err))
+						info.setError(err)
+						failed = true
+						cancel()
+						continue
 					}
 					if err := w.Flush(); err != nil {
-						logger.Error("Error flushing stream", zap.Error(err))
-						return
+						reqLogger.Error("Error flushing stream", zap.Error(err))
+						info.setError(err)
+						failed = true
+						cancel()
 					}
 				}
 			}
@@ -98,36 +226,111 @@ func ChatCompletions(config *Config) func(c *fiber.Ctx) error {
 			return nil
 		}
 
-		response, err := generateResponse(req, conversationId, config)
+		defer done()
+		defer cancel()
+
+		response, err := generateResponse(ctx, req, messages, conversationId, config)
+		if err != nil {
+			info.setError(err)
+		}
+		if errors.Is(err, errShuttingDown) {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(newErrorResponse("server_error", "server_shutdown", err.Error()))
+		}
+		if errors.Is(err, errQueueFull) || errors.Is(err, errQueueTimeout) {
+			return c.Status(fiber.StatusTooManyRequests).JSON(queueErrorResponse(err))
+		}
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 		}
 
+		c.Set("X-Model-Used", response.Model)
+		return c.JSON(response)
+	}
+}
+
+// Moderations checks texts against the content policy of the token, the
+// same rules that filter chat completions.
+func Moderations(store *ConfigStore) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		config := store.Get()
+		var req ModerationRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		var inputs []string
+		if err := json.Unmarshal(req.Input, &inputs); err != nil {
+			var input string
+			if err := json.Unmarshal(req.Input, &input); err != nil {
+				reqErr := newRequestError(fiber.StatusBadRequest, "invalid_value", "input", "input must be a string or an array of strings")
+				return c.Status(reqErr.status).JSON(reqErr.response)
+			}
+			inputs = []string{input}
+		}
+
+		tokenName := requestInfoFromContext(c.UserContext()).getTokenName()
+		response := ModerationResponse{
+			ID:      "modr-" + generateUUID(),
+			Model:   "content-policy",
+			Results: make([]ModerationResult, len(inputs)),
+		}
+		for i, input := range inputs {
+			response.Results[i] = moderate(config, tokenName, input)
+		}
 		return c.JSON(response)
 	}
 }
 
-func EndConversation(config *Config) func(c *fiber.Ctx) error {
+func EndConversation(store *ConfigStore) func(c *fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
-		return c.SendStatus(fiber.StatusNotImplemented)
+		info := requestInfoFromContext(c.UserContext())
+		conversationId := c.Params("id")
+		// 其他令牌的对话和不存在的对话一样返回 404
+		if !deleteConversation(conversationId, info.getTokenName()) {
+			reqErr := newRequestError(fiber.StatusNotFound, "conversation_not_found", "", fmt.Sprintf("the conversation %s does not exist", conversationId))
+			return c.Status(reqErr.status).JSON(reqErr.response)
+		}
+		info.logger().Debug("deleted conversation", zap.String("conversation_id", conversationId))
+		return c.SendStatus(fiber.StatusNoContent)
 	}
 }
 
-func streamResponse(req ChatCompletionRequest, conversationId string, channel chan string, config *Config) {
+// streamResponse streams the reply to req. conversationHistory is what is
+// sent upstream, req.Messages fitted to the context window, while the whole
+// of req.Messages is stored as the conversation.
+func streamResponse(ctx context.Context, req ChatCompletionRequest, conversationHistory []ChatMessage, conversationId string, channel chan string, config *Config) {
 	defer close(channel)
 
+	info := requestInfoFromContext(ctx)
+	reqLogger := info.logger()
+
+	activeStreams.Inc()
+	defer activeStreams.Dec()
+	start := time.Now()
+	var firstChunkAt time.Time
+
 	// 将当前对话历史加入到conversations中
-	conversationMutex.Lock()
-	conversations[conversationId] = req.Messages
-	conversationHistory := conversations[conversationId]
-	conversationMutex.Unlock()
+	saveConversation(ctx, conversationId, req.Messages)
 
 	// 创建用于存储完整响应的buffer
 	var fullResponse string
 
+	// hook 处理回复，拦截回复时停止上游请求
+	transformer := newReplyTransformer(ctx, config, &req)
+	upstreamCtx, stopUpstream := context.WithCancel(ctx)
+	defer stopUpstream()
+
 	// 创建响应通道
 	responseChan := make(chan string)
-	errorChan := make(chan error)
+	errorChan := make(chan error, 1)
+	// 上游请求排队时的位置，由下面的循环用 SSE 注释发给客户端
+	positionChan := make(chan int)
+	onPosition := func(position int) {
+		select {
+		case positionChan <- position:
+		case <-upstreamCtx.Done():
+		}
+	}
 
 	// 在goroutine中处理DuckDuckGo的响应
 	go func() {
@@ -139,119 +342,224 @@ func streamResponse(req ChatCompletionRequest, conversationId string, channel ch
 			return contents
 		}(), " ")
 
-		if err := chatWithDuckDuckGo(query, req.Model, conversationHistory, responseChan, config); err != nil {
+		if err := coalescedChat(upstreamCtx, req, query, conversationHistory, responseChan, config, onPosition); err != nil {
 			errorChan <- err
 			return
 		}
+		close(responseChan)
 	}()
 
+	// 出错时发送错误事件
+	fail := func(err error) {
+		info.setError(err)
+		auditor.record(config, info, auditRecord{
+			ConversationID: conversationId,
+			Model:          req.Model,
+			UpstreamModel:  upstreamModel(config, info.getModelUsed(req.Model)),
+			Stream:         true,
+			Messages:       req.Messages,
+			Response:       fullResponse,
+			Error:          err.Error(),
+		})
+		errorResponse := struct {
+			Error string `json:"error"`
+		}{
+			Error: err.Error(),
+		}
+
+		errorJSON, _ := json.Marshal(errorResponse)
+		channel <- fmt.Sprintf("data: %s\n\n", string(errorJSON))
+	}
+
+	// 发送一段内容，hook 留下的空内容不发送
+	send := func(content string) bool {
+		if content == "" {
+			return true
+		}
+		fullResponse += content
+
+		// 创建流式响应
+		response := ChatCompletionStreamResponse{
+			ID:      conversationId,
+			Created: time.Now().Unix(),
+			Model:   info.getModelUsed(req.Model),
+			Object:  "chat.completion.chunk",
+			Choices: []ChatCompletionStreamResponseChoice{
+				{
+					Index: 0,
+					Delta: DeltaMessage{
+						Content: &content,
+					},
+				},
+			},
+		}
+
+		// 序列化并发送响应
+		responseJSON, err := json.Marshal(response)
+		if err != nil {
+			reqLogger.Error("Error marshaling response", zap.Error(err))
+			return false
+		}
+
+		channel <- fmt.Sprintf("data: %s\n\n", string(responseJSON))
+
+		// 添加一个小延迟模拟真实的流式响应
+		time.Sleep(time.Duration(50+rand.Intn(50)) * time.Millisecond)
+		return true
+	}
+
+	// 发送完成标记并保存回复
+	finish := func(finishReason string) {
+		// 客户端已经收到了内容，PostResponse 的结果只用于保存
+		stored, err := runPostResponse(ctx, config, &req, fullResponse)
+		if errors.Is(err, ErrBlocked) {
+			finishReason = "content_filter"
+		}
+		if err != nil {
+			reqLogger.Warn("post-response hook failed", zap.Error(err))
+			stored = fullResponse
+		}
+
+		response := ChatCompletionStreamResponse{
+			ID:      conversationId,
+			Created: time.Now().Unix(),
+			Model:   info.getModelUsed(req.Model),
+			Object:  "chat.completion.chunk",
+			Choices: []ChatCompletionStreamResponseChoice{
+				{
+					Index:        0,
+					Delta:        DeltaMessage{},
+					FinishReason: &finishReason,
+				},
+			},
+		}
+
+		responseJSON, _ := json.Marshal(response)
+		channel <- fmt.Sprintf("data: %s\n\n", string(responseJSON))
+		channel <- "data: [DONE]\n\n"
+
+		for _, msg := range conversationHistory {
+			info.promptTokens.Add(int64(estimateTokens(msg.Content)))
+		}
+		info.completionTokens.Store(int64(estimateTokens(stored)))
+		// 被拦截的回复不写入缓存
+		if finishReason == "stop" {
+			storeCompletion(config, info, stored, int(info.promptTokens.Load()), int(info.completionTokens.Load()))
+		}
+		auditor.record(config, info, auditRecord{
+			ConversationID: conversationId,
+			Model:          req.Model,
+			UpstreamModel:  upstreamModel(config, info.getModelUsed(req.Model)),
+			Stream:         true,
+			Messages:       req.Messages,
+			Response:       stored,
+		})
+
+		if elapsed := time.Since(firstChunkAt).Seconds(); !firstChunkAt.IsZero() && elapsed > 0 {
+			streamTokensPerSecond.WithLabelValues(req.Model).Observe(float64(estimateTokens(fullResponse)) / elapsed)
+		}
+
+		// 更新conversations
+		appendConversation(conversationId, ChatMessage{
+			Role:    "assistant",
+			Content: stored,
+		})
+		conversationSummaries.maybeSummarize(ctx, config, conversationId)
+	}
+
 	// 处理响应
 	for {
 		select {
 		case chunk, ok := <-responseChan:
 			if !ok {
-				// 发送完成标记
-				response := ChatCompletionStreamResponse{
-					ID:      conversationId,
-					Created: time.Now().Unix(),
-					Model:   req.Model,
-					Object:  "chat.completion.chunk",
-					Choices: []ChatCompletionStreamResponseChoice{
-						{
-							Index: 0,
-							Delta: DeltaMessage{},
-							FinishReason: func() *string {
-								s := "stop"
-								return &s
-							}(),
-						},
-					},
+				// hook 留下的内容在结束前发出
+				rest, err := transformer.flush()
+				if errors.Is(err, ErrBlocked) {
+					finish("content_filter")
+					return
+				}
+				if err != nil {
+					fail(err)
+					return
+				}
+				if send(rest) {
+					finish("stop")
 				}
-
-				responseJSON, _ := json.Marshal(response)
-				channel <- fmt.Sprintf("data: %s\n\n", string(responseJSON))
-				channel <- "data: [DONE]\n\n"
-
-				// 更新conversations
-				conversationMutex.Lock()
-				conversations[conversationId] = append(
-					conversations[conversationId],
-					ChatMessage{
-						Role:    "assistant",
-						Content: fullResponse,
-					},
-				)
-				conversationMutex.Unlock()
-
 				return
 			}
 
-			fullResponse += chunk
-
-			// 创建流式响应
-			response := ChatCompletionStreamResponse{
-				ID:      conversationId,
-				Created: time.Now().Unix(),
-				Model:   req.Model,
-				Object:  "chat.completion.chunk",
-				Choices: []ChatCompletionStreamResponseChoice{
-					{
-						Index: 0,
-						Delta: DeltaMessage{
-							Content: &chunk,
-						},
-					},
-				},
+			if firstChunkAt.IsZero() {
+				firstChunkAt = time.Now()
+				streamTimeToFirstToken.WithLabelValues(req.Model).Observe(firstChunkAt.Sub(start).Seconds())
 			}
 
-			// 序列化并发送响应
-			responseJSON, err := json.Marshal(response)
+			content, err := transformer.transform(chunk)
 			if err != nil {
-				logger.Error("Error marshaling response", zap.Error(err))
+				// 不再需要上游剩下的内容
+				stopUpstream()
+				if errors.Is(err, ErrBlocked) {
+					finish("content_filter")
+				} else {
+					fail(err)
+				}
+				return
+			}
+			if !send(content) {
 				return
 			}
 
-			channel <- fmt.Sprintf("data: %s\n\n", string(responseJSON))
-
-			// 添加一个小延迟模拟真实的流式响应
-			time.Sleep(time.Duration(50+rand.Intn(50)) * time.Millisecond)
+		case position := <-positionChan:
+			channel <- fmt.Sprintf(": queue position %d\n\n", position)
 
 		case err := <-errorChan:
-			// 处理错误
-			errorResponse := struct {
-				Error string `json:"error"`
-			}{
-				Error: err.Error(),
+			if errors.Is(err, errQueueFull) || errors.Is(err, errQueueTimeout) {
+				info.setError(err)
+				errorJSON, _ := json.Marshal(queueErrorResponse(err))
+				channel <- fmt.Sprintf("data: %s\n\n", string(errorJSON))
+				channel <- "data: [DONE]\n\n"
+				return
 			}
+			// 处理错误
+			fail(err)
+			return
 
-			errorJSON, _ := json.Marshal(errorResponse)
-			channel <- fmt.Sprintf("data: %s\n\n", string(errorJSON))
+		case <-ctx.Done():
+			// 关闭超时后终止流，客户端已断开时直接退出
+			if inflight.aborted() {
+				reqLogger.Warn("aborting stream on shutdown", zap.String("conversation_id", conversationId))
+				info.setError(errShuttingDown)
+				errorJSON, _ := json.Marshal(newErrorResponse("server_error", "server_shutdown", errShuttingDown.Error()))
+				channel <- fmt.Sprintf("data: %s\n\n", string(errorJSON))
+				channel <- "data: [DONE]\n\n"
+			}
 			return
 
 		case <-time.After(30 * time.Second):
 			// 超时处理
-			logger.Error("Stream response timeout")
+			reqLogger.Error("Stream response timeout")
+			info.setError(fmt.Errorf("stream response timeout"))
 			return
 		}
 	}
 }
 
-func generateResponse(req ChatCompletionRequest, conversationId string, config *Config) (*ChatCompletionResponse, error) {
+// generateResponse returns the whole reply to req, see streamResponse.
+func generateResponse(ctx context.Context, req ChatCompletionRequest, conversationHistory []ChatMessage, conversationId string, config *Config) (*ChatCompletionResponse, error) {
+	info := requestInfoFromContext(ctx)
+	reqLogger := info.logger()
+
 	// 将当前对话历史加入到conversations中
-	conversationMutex.Lock()
-	conversations[conversationId] = req.Messages
-	conversationHistory := conversations[conversationId]
-	conversationMutex.Unlock()
+	saveConversation(ctx, conversationId, req.Messages)
 
 	// 创建响应channel
 	responseChan := make(chan string)
-	done := make(chan bool)
-	errorChan := make(chan error)
+	done := make(chan bool, 1)
+	errorChan := make(chan error, 1)
 	var fullResponse string
 
 	// 在goroutine中处理DuckDuckGo的响应
 	go func() {
-		logger.Debug("deal with duckduckgo response")
+		reqLogger.Debug("deal with duckduckgo response")
 		query := strings.Join(func() []string {
 			var contents []string
 			for _, msg := range req.Messages {
@@ -260,8 +568,8 @@ func generateResponse(req ChatCompletionRequest, conversationId string, config *
 			return contents
 		}(), " ")
 
-		if err := chatWithDuckDuckGo(query, req.Model, conversationHistory, responseChan, config); err != nil {
-			logger.Error("failed to chat with duckduckgo", zap.Error(err))
+		if err := coalescedChat(ctx, req, query, conversationHistory, responseChan, config, func(int) {}); err != nil {
+			reqLogger.Error("failed to chat with duckduckgo", zap.Error(err))
 			errorChan <- err
 			return
 		}
@@ -278,9 +586,41 @@ func generateResponse(req ChatCompletionRequest, conversationId string, config *
 			fullResponse += chunk
 
 		case err := <-errorChan:
+			if ctx.Err() != nil {
+				return nil, errShuttingDown
+			}
+			if errors.Is(err, errQueueFull) || errors.Is(err, errQueueTimeout) {
+				return nil, err
+			}
+			auditor.record(config, info, auditRecord{
+				ConversationID: conversationId,
+				Model:          req.Model,
+				UpstreamModel:  upstreamModel(config, info.getModelUsed(req.Model)),
+				Messages:       req.Messages,
+				Response:       fullResponse,
+				Error:          err.Error(),
+			})
 			return nil, err
 
 		case <-done:
+			// hook 处理完整的回复，被拦截时不返回内容
+			finishReason := "stop"
+			transformed, err := transformReply(ctx, config, &req, fullResponse)
+			if errors.Is(err, ErrBlocked) {
+				finishReason = "content_filter"
+			} else if err != nil {
+				auditor.record(config, info, auditRecord{
+					ConversationID: conversationId,
+					Model:          req.Model,
+					UpstreamModel:  upstreamModel(config, info.getModelUsed(req.Model)),
+					Messages:       req.Messages,
+					Response:       fullResponse,
+					Error:          err.Error(),
+				})
+				return nil, err
+			}
+			fullResponse = transformed
+
 			// 计算token数量（这里用简单的分词方式估算，实际项目中可能需要更准确的token计算方法）
 			promptTokens := 0
 			for _, msg := range conversationHistory {
@@ -288,13 +628,25 @@ func generateResponse(req ChatCompletionRequest, conversationId string, config *
 			}
 			completionTokens := len(strings.Split(fullResponse, " "))
 			totalTokens := promptTokens + completionTokens
+			info.promptTokens.Store(int64(promptTokens))
+			info.completionTokens.Store(int64(completionTokens))
+			if finishReason == "stop" {
+				storeCompletion(config, info, fullResponse, promptTokens, completionTokens)
+			}
+			auditor.record(config, info, auditRecord{
+				ConversationID: conversationId,
+				Model:          req.Model,
+				UpstreamModel:  upstreamModel(config, info.getModelUsed(req.Model)),
+				Messages:       req.Messages,
+				Response:       fullResponse,
+			})
 
 			// 构建响应
 			response := &ChatCompletionResponse{
 				ID:      conversationId,
 				Object:  "chat.completion",
 				Created: time.Now().Unix(),
-				Model:   req.Model,
+				Model:   info.getModelUsed(req.Model),
 				Choices: []ChatCompletionResponseChoice{
 					{
 						Index: 0,
@@ -302,10 +654,7 @@ func generateResponse(req ChatCompletionRequest, conversationId string, config *
 							Role:    "assistant",
 							Content: fullResponse,
 						},
-						FinishReason: func() *string {
-							s := "stop"
-							return &s
-						}(),
+						FinishReason: &finishReason,
 					},
 				},
 				Usage: ChatCompletionResponseUsage{
@@ -316,28 +665,29 @@ func generateResponse(req ChatCompletionRequest, conversationId string, config *
 			}
 
 			// 更新对话历史
-			conversationMutex.Lock()
-			conversations[conversationId] = append(
-				conversations[conversationId],
-				ChatMessage{
-					Role:    "assistant",
-					Content: fullResponse,
-				},
-			)
-			conversationMutex.Unlock()
+			appendConversation(conversationId, ChatMessage{
+				Role:    "assistant",
+				Content: fullResponse,
+			})
+			conversationSummaries.maybeSummarize(ctx, config, conversationId)
 
 			return response, nil
 
+		case <-ctx.Done():
+			return nil, errShuttingDown
+
 		case <-time.After(30 * time.Second):
 			return nil, fmt.Errorf("response generation timeout")
 		}
 	}
 }
 
-func RegisterRoutes(app *fiber.App, config *Config) {
-	api := app.Group("/v1", AuthMiddleware(config))
+func RegisterRoutes(app *fiber.App, store *ConfigStore) {
+	api := app.Group("/v1", AuthMiddleware(store))
 
-	api.Get("/models", ListModels(config))
-	api.Post("/chat/completions", ChatCompletions(config))
-	api.Delete("/conversations/:id", EndConversation(config))
+	api.Get("/models", ListModels(store))
+	api.Get("/models/+", GetModel(store))
+	api.Post("/chat/completions", ChatCompletions(store))
+	api.Post("/moderations", Moderations(store))
+	api.Delete("/conversations/:id", EndConversation(store))
 }
@@ -0,0 +1,63 @@
+package ddgchat
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestChatCompletionsStoresWholeHistory(t *testing.T) {
+	upstream := make(chan []ChatMessage, 1)
+	server := newStubUpstream(t, map[string]http.HandlerFunc{
+		"/duckchat/v1/chat": func(w http.ResponseWriter, r *http.Request) {
+			var payload struct {
+				Messages []ChatMessage `json:"messages"`
+			}
+			json.NewDecoder(r.Body).Decode(&payload)
+			upstream <- payload.Messages
+			writeChatEvents(w, "ok")
+		},
+	})
+	config := stubConfig(server)
+	config.ModelMapping = map[string]ModelEntry{"small": {Model: "gpt-4o-mini", ContextWindow: 5}}
+
+	app := fiber.New()
+	app.Post("/v1/chat/completions", ChatCompletions(NewConfigStore("", config, nil)))
+
+	body := `{"model":"small","messages":[
+		{"role":"user","content":"first turn"},
+		{"role":"assistant","content":"first reply"},
+		{"role":"user","content":"second turn"},
+		{"role":"assistant","content":"second reply"},
+		{"role":"user","content":"third turn"}]}`
+	req := httptest.NewRequest(fiber.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	if dropped := resp.Header.Get("X-Context-Dropped-Messages"); dropped == "0" {
+		t.Fatal("no messages dropped, the test needs a smaller context window")
+	}
+
+	// 上游只收到放得下的消息
+	sent := <-upstream
+	if len(sent) != 2 || sent[len(sent)-1].Content != "third turn" {
+		t.Errorf("sent upstream %v, want the last two user messages", sent)
+	}
+	// 保存的对话包含全部消息和回复，由摘要而不是上下文策略缩短
+	stored, ok := loadConversation(resp.Header.Get("X-Conversation-Id"))
+	if !ok {
+		t.Fatal("conversation not stored")
+	}
+	if len(stored) != 6 || stored[0].Content != "first turn" || stored[5].Content != "ok" {
+		t.Errorf("stored %v, want the whole history and the reply", stored)
+	}
+}
@@ -1,56 +1,108 @@
 package ddgchat
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/healthcheck"
-	fiberLogger "github.com/gofiber/fiber/v2/middleware/logger"
 	loggerPkg "github.com/nerdneilsfield/shlogin/pkg/logger"
 	"go.uber.org/zap"
+	"golang.org/x/exp/rand"
 )
 
 var logger = loggerPkg.GetLogger()
 
 // 全局变量
 var (
-	conversations     = make(map[string][]ChatMessage)
-	conversationMutex sync.RWMutex
+	conversations = make(map[string][]ChatMessage)
+	// 创建对话的令牌名称，其他令牌不能继续或删除这个对话
+	conversationOwners = make(map[string]string)
+	conversationMutex  sync.RWMutex
 )
 
 func HelloWorld(c *fiber.Ctx) error {
 	return c.SendString("Hello, World!")
 }
 
-func RunServer(config *Config) error {
+// RunServer serves the API until ctx is cancelled, then shuts down
+// gracefully, see Config.ShutdownTimeout.
+func RunServer(ctx context.Context, store *ConfigStore) error {
+	// 先注册 SIGHUP，启动期间收到的信号也只会触发重新加载，而不是按默认动作结束进程
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	defer signal.Stop(hupChan)
+
+	// x/exp/rand 的全局随机源默认使用固定种子，不设置的话每次启动选出的指纹顺序都相同
+	rand.Seed(uint64(time.Now().UnixNano()))
+
+	config := store.Get()
 	app := fiber.New()
 
 	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET, POST, OPTIONS, DELETE",
-		AllowHeaders: "Origin, Content-Type, Accept, Authorization",
+		AllowOrigins:  "*",
+		AllowMethods:  "GET, POST, OPTIONS, DELETE",
+		AllowHeaders:  "Origin, Content-Type, Accept, Authorization, X-Request-Id, traceparent, tracestate",
+		ExposeHeaders: "X-Request-Id",
 	}))
 
-	app.Use(fiberLogger.New())
+	app.Use(RequestLogMiddleware())
 	app.Use(healthcheck.New(healthcheck.Config{
 		LivenessProbe: func(c *fiber.Ctx) bool {
 			return true
 		},
 		LivenessEndpoint: "/live",
 		ReadinessProbe: func(c *fiber.Ctx) bool {
-			return true
+			return upstreamHealth.ready(store.Get())
 		},
 		ReadinessEndpoint: "/ready",
 	}))
 
+	shutdownTracing, err := SetupTracing(ctx, config.Tracing)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logger.Error("failed to flush traces", zap.Error(err))
+		}
+	}()
+	app.Use(TracingMiddleware())
+	defer auditor.close()
+
 	app.Get("/", HelloWorld)
+	app.Get("/health", HealthHandler(store))
+	if config.Metrics.Enabled {
+		app.Use(MetricsMiddleware())
+		app.Get(config.Metrics.Path, MetricsHandler())
+	}
 
-	RegisterRoutes(app, config)
+	RegisterRoutes(app, store)
+
+	go upstreamHealth.run(ctx, store)
+	go upstreamModels.run(ctx, store)
+
+	go store.Watch(ctx, hupChan)
 
 	listenAddr := fmt.Sprintf("%s:%d", config.Host, config.Port)
 	logger.Info("Starting server", zap.String("listen_addr", listenAddr))
 
-	return app.Listen(listenAddr)
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- app.Listen(listenAddr)
+	}()
+
+	select {
+	case err := <-listenErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	return shutdownServer(app, store.Get().ShutdownTimeout)
 }
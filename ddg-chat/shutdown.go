@@ -0,0 +1,106 @@
+package ddgchat
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+// 超过关闭期限后，给被终止的流多少时间发送最后的错误事件
+const abortGrace = 5 * time.Second
+
+var errShuttingDown = errors.New("server is shutting down")
+
+// completionTracker counts in-flight completions so shutdown can wait for
+// them, and cancels the ones still running once the deadline passes.
+type completionTracker struct {
+	draining atomic.Bool
+	active   sync.WaitGroup
+	mu       sync.Mutex
+	abortCtx context.Context
+	abortFn  context.CancelFunc
+}
+
+func newCompletionTracker() *completionTracker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &completionTracker{abortCtx: ctx, abortFn: cancel}
+}
+
+// 全局的进行中请求跟踪
+var inflight = newCompletionTracker()
+
+// begin registers a completion. The returned context is cancelled when the
+// server aborts remaining completions. ok is false while draining.
+func (t *completionTracker) begin() (ctx context.Context, done func(), ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining.Load() {
+		return nil, nil, false
+	}
+
+	t.active.Add(1)
+	var once sync.Once
+	return t.abortCtx, func() { once.Do(t.active.Done) }, true
+}
+
+func (t *completionTracker) isDraining() bool {
+	return t.draining.Load()
+}
+
+func (t *completionTracker) aborted() bool {
+	return t.abortCtx.Err() != nil
+}
+
+// drain stops new completions and waits up to timeout for active ones.
+// Completions still running after that are aborted.
+func (t *completionTracker) drain(timeout time.Duration) {
+	t.mu.Lock()
+	t.draining.Store(true)
+	t.mu.Unlock()
+
+	if t.wait(timeout) {
+		logger.Info("all completions finished")
+		return
+	}
+
+	logger.Warn("shutdown timeout reached, aborting remaining completions", zap.Duration("timeout", timeout))
+	t.abortFn()
+	if !t.wait(abortGrace) {
+		logger.Error("completions did not stop after abort")
+	}
+}
+
+func (t *completionTracker) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		t.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// shutdownServer stops accepting connections, lets active completions
+// finish within the configured timeout, then stops the server.
+func shutdownServer(app *fiber.App, timeout time.Duration) error {
+	logger.Info("shutting down server", zap.Duration("timeout", timeout))
+
+	shutdownDone := make(chan error, 1)
+	go func() {
+		shutdownDone <- app.ShutdownWithTimeout(timeout + abortGrace)
+	}()
+
+	inflight.drain(timeout)
+
+	return <-shutdownDone
+}
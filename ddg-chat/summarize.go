@@ -0,0 +1,249 @@
+package ddgchat
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type SummarizationConfig struct {
+	// 对话过长时把较早的消息总结成一条消息，只作用于服务端保存的对话
+	Enabled bool `toml:"enabled"`
+	// 非 system 消息超过这个数量时开始总结
+	MaxMessages int `toml:"max_messages"`
+	// 总结时保留的最近消息数
+	KeepRecent int `toml:"keep_recent"`
+	// 用来总结的模型，model_mapping 中的名称
+	Model   string        `toml:"model"`
+	Prompt  string        `toml:"prompt"`
+	Timeout time.Duration `toml:"timeout"`
+}
+
+// 总结消息的前缀，也用来识别之前的总结
+const summaryPrefix = "[Summary of the earlier conversation]\n"
+
+func defaultSummarizationConfig() SummarizationConfig {
+	return SummarizationConfig{
+		MaxMessages: 20,
+		KeepRecent:  6,
+		Model:       "ddg/gpt-4o-mini",
+		Prompt:      "Summarize the following conversation between a user and an assistant. Keep every fact, decision, name, number and open question that later turns may depend on. Answer with the summary only.",
+		Timeout:     time.Minute,
+	}
+}
+
+func validateSummarizationConfig(config SummarizationConfig, mapping map[string]ModelEntry) []ConfigProblem {
+	if !config.Enabled {
+		return nil
+	}
+
+	var problems []ConfigProblem
+	if config.KeepRecent < 1 {
+		problems = append(problems, ConfigProblem{Key: "summarization.keep_recent", Message: "must be at least 1"})
+	}
+	if config.MaxMessages <= config.KeepRecent {
+		problems = append(problems, ConfigProblem{Key: "summarization.max_messages", Message: "must be larger than keep_recent"})
+	}
+	if _, ok := mapping[config.Model]; !ok {
+		problems = append(problems, ConfigProblem{Key: "summarization.model", Message: fmt.Sprintf("model %s is not in model_mapping", config.Model)})
+	}
+	if config.Timeout <= 0 {
+		problems = append(problems, ConfigProblem{Key: "summarization.timeout", Message: fmt.Sprintf("invalid timeout: %s", config.Timeout)})
+	}
+	return problems
+}
+
+// loadConversation returns a copy of a stored conversation.
+func loadConversation(conversationId string) ([]ChatMessage, bool) {
+	conversationMutex.RLock()
+	defer conversationMutex.RUnlock()
+	history, ok := conversations[conversationId]
+	return slices.Clone(history), ok
+}
+
+// ownedConversation returns a copy of a stored conversation created with
+// the token tokenName. Conversations of other tokens are reported as
+// missing.
+func ownedConversation(conversationId string, tokenName string) ([]ChatMessage, bool) {
+	conversationMutex.RLock()
+	defer conversationMutex.RUnlock()
+	history, ok := conversations[conversationId]
+	if !ok || conversationOwners[conversationId] != tokenName {
+		return nil, false
+	}
+	return slices.Clone(history), true
+}
+
+// saveConversation stores the history of a conversation, owned by the token
+// of the request in ctx.
+func saveConversation(ctx context.Context, conversationId string, history []ChatMessage) {
+	tokenName := requestInfoFromContext(ctx).getTokenName()
+	conversationMutex.Lock()
+	defer conversationMutex.Unlock()
+	conversations[conversationId] = history
+	conversationOwners[conversationId] = tokenName
+}
+
+// appendConversation adds a reply to a stored conversation. A conversation
+// deleted in the meantime stays deleted.
+func appendConversation(conversationId string, message ChatMessage) {
+	conversationMutex.Lock()
+	defer conversationMutex.Unlock()
+	if history, ok := conversations[conversationId]; ok {
+		conversations[conversationId] = append(history, message)
+	}
+}
+
+// deleteConversation removes a conversation created with the token
+// tokenName and reports whether there was one.
+func deleteConversation(conversationId string, tokenName string) bool {
+	conversationMutex.Lock()
+	defer conversationMutex.Unlock()
+	if _, ok := conversations[conversationId]; !ok || conversationOwners[conversationId] != tokenName {
+		return false
+	}
+	delete(conversations, conversationId)
+	delete(conversationOwners, conversationId)
+	return true
+}
+
+// summarizer runs at most one summarization per conversation at a time.
+type summarizer struct {
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+// 全局的对话总结
+var conversationSummaries = &summarizer{running: make(map[string]bool)}
+
+// maybeSummarize starts summarizing the older turns of a stored
+// conversation in the background once it has more than max_messages
+// non-system messages.
+func (s *summarizer) maybeSummarize(ctx context.Context, config *Config, conversationId string) {
+	if !config.Summarization.Enabled {
+		return
+	}
+	history, ok := loadConversation(conversationId)
+	if !ok || countTurns(history) <= config.Summarization.MaxMessages {
+		return
+	}
+
+	s.mu.Lock()
+	if s.running[conversationId] {
+		s.mu.Unlock()
+		return
+	}
+	s.running[conversationId] = true
+	s.mu.Unlock()
+
+	// 在请求结束后继续运行，沿用请求的日志字段和 token，但不计入请求的统计
+	parent := requestInfoFromContext(ctx)
+	info := &requestInfo{id: parent.id, log: parent.logger(), tokenName: parent.getTokenName()}
+	ctx, cancel := context.WithTimeout(withRequestInfo(context.WithoutCancel(ctx), info), config.Summarization.Timeout)
+	go func() {
+		defer cancel()
+		defer func() {
+			s.mu.Lock()
+			delete(s.running, conversationId)
+			s.mu.Unlock()
+		}()
+		s.summarize(ctx, config, conversationId, history)
+	}()
+}
+
+func (s *summarizer) summarize(ctx context.Context, config *Config, conversationId string, history []ChatMessage) {
+	info := requestInfoFromContext(ctx)
+	reqLogger := info.logger().With(zap.String("conversation_id", conversationId))
+
+	// 保留最近 keep_recent 条非 system 消息，之前的非 system 消息被总结
+	cut, kept := len(history), 0
+	for cut > 0 && kept < config.Summarization.KeepRecent {
+		cut--
+		if history[cut].Role != "system" {
+			kept++
+		}
+	}
+	older := history[:cut]
+
+	var transcript strings.Builder
+	var systemMsgs []ChatMessage
+	for _, msg := range older {
+		if msg.Role == "system" {
+			systemMsgs = append(systemMsgs, msg)
+			continue
+		}
+		// 之前的总结也一起总结，标明它不是用户说的话
+		role := msg.Role
+		if content, ok := strings.CutPrefix(msg.Content, summaryPrefix); ok {
+			role, msg.Content = "summary of earlier turns", content
+		}
+		fmt.Fprintf(&transcript, "%s: %s\n\n", role, msg.Content)
+	}
+
+	summary, err := s.complete(ctx, config, info.getTokenName(), config.Summarization.Prompt+"\n\n"+transcript.String())
+	if err != nil {
+		summarizations.WithLabelValues("error").Inc()
+		reqLogger.Error("failed to summarize conversation", zap.Error(err))
+		return
+	}
+
+	conversationMutex.Lock()
+	defer conversationMutex.Unlock()
+	current, ok := conversations[conversationId]
+	// 总结期间对话被删除或被覆盖时放弃这次总结
+	if !ok || len(current) < cut || !slices.Equal(current[:cut], older) {
+		summarizations.WithLabelValues("discarded").Inc()
+		return
+	}
+	replaced := append(systemMsgs, ChatMessage{Role: "user", Content: summaryPrefix + summary})
+	conversations[conversationId] = append(replaced, current[cut:]...)
+	summarizations.WithLabelValues("success").Inc()
+	reqLogger.Info("summarized conversation", zap.Int("summarized_messages", cut-len(systemMsgs)), zap.Int("messages", len(conversations[conversationId])))
+}
+
+// complete runs one summarizer request through the queue and the usual
+// upstream path and returns the whole reply.
+func (s *summarizer) complete(ctx context.Context, config *Config, tokenName string, prompt string) (string, error) {
+	release, err := upstreamQueue.acquire(ctx, config.Queue, tokenName, func(int) {})
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	channel := make(chan string)
+	result := make(chan string, 1)
+	go func() {
+		var reply strings.Builder
+		for chunk := range channel {
+			reply.WriteString(chunk)
+		}
+		result <- reply.String()
+	}()
+
+	history := []ChatMessage{{Role: "user", Content: prompt}}
+	err = chatWithFallbacks(ctx, prompt, config.Summarization.Model, history, channel, config, func(string) {})
+	close(channel)
+	summary := strings.TrimSpace(<-result)
+	if err != nil {
+		return "", err
+	}
+	if summary == "" {
+		return "", fmt.Errorf("summarizer returned an empty reply")
+	}
+	return summary, nil
+}
+
+func countTurns(history []ChatMessage) int {
+	turns := 0
+	for _, msg := range history {
+		if msg.Role != "system" {
+			turns++
+		}
+	}
+	return turns
+}
@@ -0,0 +1,181 @@
+package ddgchat
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type TracingConfig struct {
+	// 修改后需要重启才能生效
+	Enabled bool `toml:"enabled"`
+	// OTLP/HTTP 地址，例如 "localhost:4318"
+	Endpoint    string            `toml:"endpoint"`
+	Insecure    bool              `toml:"insecure"`
+	Headers     map[string]string `toml:"headers" secret:"true"`
+	ServiceName string            `toml:"service_name"`
+	SampleRatio float64           `toml:"sample_ratio"`
+}
+
+func defaultTracingConfig() TracingConfig {
+	return TracingConfig{
+		Endpoint:    "localhost:4318",
+		ServiceName: "go-ddg-chat-api",
+		SampleRatio: 1,
+	}
+}
+
+// 使用全局 TracerProvider，测试中可以用 otel.SetTracerProvider 换成内存 exporter
+var tracer = otel.Tracer("github.com/nerdneilsfield/go-ddg-chat-api/ddg-chat")
+
+// SetupTracing installs a global OTLP tracer provider and the W3C trace
+// context propagator. The returned function flushes and stops the exporter.
+func SetupTracing(ctx context.Context, config TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if !config.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.Endpoint)}
+	if config.Insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	if len(config.Headers) > 0 {
+		options = append(options, otlptracehttp.WithHeaders(config.Headers))
+	}
+
+	exporter, err := otlptracehttp.New(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", config.ServiceName),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	logger.Info("tracing enabled")
+	return provider.Shutdown, nil
+}
+
+// fiberHeaderCarrier adapts fiber request and response headers for the
+// propagator.
+type fiberHeaderCarrier struct {
+	c *fiber.Ctx
+}
+
+func (h fiberHeaderCarrier) Get(key string) string {
+	return h.c.Get(key)
+}
+
+func (h fiberHeaderCarrier) Set(key string, value string) {
+	h.c.Set(key, value)
+}
+
+func (h fiberHeaderCarrier) Keys() []string {
+	var keys []string
+	h.c.Request().Header.VisitAll(func(key, _ []byte) {
+		keys = append(keys, string(key))
+	})
+	return keys
+}
+
+// TracingMiddleware starts a server span per request, continuing the trace
+// from an incoming traceparent header. The span context is stored as the
+// request's user context. Streaming completions end the span themselves
+// when the stream is done, see endRequestSpan.
+func TracingMiddleware() func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		ctx := otel.GetTextMapPropagator().Extract(c.UserContext(), fiberHeaderCarrier{c})
+		ctx, span := tracer.Start(ctx, c.Method()+" "+c.Path(),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", c.Method()),
+				attribute.String("url.path", c.Path()),
+				attribute.String("ddg.request_id", requestInfoFromContext(ctx).id),
+			),
+		)
+		c.SetUserContext(ctx)
+
+		err := c.Next()
+
+		span.SetName(c.Method() + " " + c.Route().Path)
+		span.SetAttributes(attribute.String("http.route", c.Route().Path))
+		if tokenName := localString(c, "token_name"); tokenName != "" {
+			span.SetAttributes(attribute.String("ddg.token_name", tokenName))
+		}
+		if model := localString(c, "model"); model != "" {
+			span.SetAttributes(attribute.String("ddg.model", model))
+		}
+
+		if stream, _ := c.Locals("stream").(bool); stream {
+			return err
+		}
+		endRequestSpan(span, c.Response().StatusCode(), err)
+		return err
+	}
+}
+
+func endRequestSpan(span trace.Span, status int, err error) {
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if err != nil {
+		span.RecordError(err)
+	}
+	if err != nil || status >= 500 {
+		span.SetStatus(codes.Error, fmt.Sprintf("status %d", status))
+	}
+	span.End()
+}
+
+// doTraced sends req through upstream inside a client span named name, and
+// reports the outcome to the proxy pool.
+func doTraced(ctx context.Context, name string, upstream *egressProxy, req *fasthttp.Request, resp *fasthttp.Response) error {
+	_, span := tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", string(req.Header.Method())),
+			attribute.String("url.full", req.URI().String()),
+			attribute.String("ddg.proxy", upstream.name),
+		),
+	)
+	defer span.End()
+
+	if err := upstream.do(req, resp); err != nil {
+		upstream.report(0, err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	upstream.report(resp.StatusCode(), nil)
+
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode()))
+	if resp.StatusCode() >= 400 {
+		span.SetStatus(codes.Error, fmt.Sprintf("status %d", resp.StatusCode()))
+	}
+	return nil
+}
+
+func spanError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
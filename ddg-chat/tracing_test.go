@@ -0,0 +1,191 @@
+package ddgchat
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var (
+	spanExporter     = tracetest.NewInMemoryExporter()
+	spanExporterOnce sync.Once
+)
+
+// recordSpans routes the package tracer to an in-memory exporter. The
+// global tracer only takes the first provider set, so it is shared by all
+// tests and emptied for each.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	spanExporterOnce.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spanExporter)))
+	})
+	spanExporter.Reset()
+	t.Cleanup(spanExporter.Reset)
+	return spanExporter
+}
+
+// spansByName returns the ended spans with name.
+func spansByName(spans tracetest.SpanStubs, name string) []tracetest.SpanStub {
+	var found []tracetest.SpanStub
+	for _, span := range spans {
+		if span.Name == name {
+			found = append(found, span)
+		}
+	}
+	return found
+}
+
+func onlySpan(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	t.Helper()
+	found := spansByName(spans, name)
+	if len(found) != 1 {
+		t.Fatalf("got %d %s spans, want 1", len(found), name)
+	}
+	return found[0]
+}
+
+func spanAttribute(span tracetest.SpanStub, key string) (interface{}, bool) {
+	for _, attr := range span.Attributes {
+		if string(attr.Key) == key {
+			return attr.Value.AsInterface(), true
+		}
+	}
+	return nil, false
+}
+
+func TestChatSpans(t *testing.T) {
+	exporter := recordSpans(t)
+	config := stubConfig(newStubUpstream(t, nil))
+
+	reply, err := collectChat(t, config, []ChatMessage{{Role: "user", Content: "hi"}})
+	if err != nil {
+		t.Fatalf("chat failed: %v", err)
+	}
+	if reply != "hello world" {
+		t.Fatalf("reply = %q", reply)
+	}
+
+	spans := exporter.GetSpans()
+	chat := onlySpan(t, spans, "ddg.chat")
+	vqd := onlySpan(t, spans, "ddg.vqd")
+	stream := onlySpan(t, spans, "ddg.chat.stream")
+
+	if chat.Parent.IsValid() {
+		t.Errorf("ddg.chat has parent %s, want a root span", chat.Parent.SpanID())
+	}
+	for _, child := range []tracetest.SpanStub{vqd, stream} {
+		if child.Parent.SpanID() != chat.SpanContext.SpanID() {
+			t.Errorf("%s parent = %s, want ddg.chat %s", child.Name, child.Parent.SpanID(), chat.SpanContext.SpanID())
+		}
+		if child.SpanContext.TraceID() != chat.SpanContext.TraceID() {
+			t.Errorf("%s is in another trace", child.Name)
+		}
+	}
+	for _, name := range []string{"GET /country.json", "GET /duckchat/v1/status"} {
+		if span := onlySpan(t, spans, name); span.Parent.SpanID() != vqd.SpanContext.SpanID() {
+			t.Errorf("%s is not a child of ddg.vqd", name)
+		}
+	}
+	if span := onlySpan(t, spans, "POST /duckchat/v1/chat"); span.Parent.SpanID() != chat.SpanContext.SpanID() {
+		t.Errorf("POST /duckchat/v1/chat is not a child of ddg.chat")
+	}
+
+	if model, _ := spanAttribute(chat, "ddg.model"); model != "ddg/gpt-4o-mini" {
+		t.Errorf("ddg.model = %v", model)
+	}
+	if retries, _ := spanAttribute(chat, "ddg.retries"); retries != int64(0) {
+		t.Errorf("ddg.retries = %v, want 0", retries)
+	}
+	if chunks, _ := spanAttribute(stream, "ddg.chunks"); chunks != int64(2) {
+		t.Errorf("ddg.chunks = %v, want 2", chunks)
+	}
+	for _, span := range spans {
+		if span.Status.Code == codes.Error {
+			t.Errorf("span %s has error status: %s", span.Name, span.Status.Description)
+		}
+	}
+}
+
+func TestChatSpansRetry(t *testing.T) {
+	exporter := recordSpans(t)
+	limited := true
+	config := stubConfig(newStubUpstream(t, map[string]http.HandlerFunc{
+		"/duckchat/v1/chat": func(w http.ResponseWriter, r *http.Request) {
+			if limited {
+				limited = false
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			writeChatEvents(w, "ok")
+		},
+	}))
+
+	if _, err := collectChat(t, config, []ChatMessage{{Role: "user", Content: "hi"}}); err != nil {
+		t.Fatalf("chat failed: %v", err)
+	}
+
+	spans := exporter.GetSpans()
+	chat := onlySpan(t, spans, "ddg.chat")
+	if retries, _ := spanAttribute(chat, "ddg.retries"); retries != int64(1) {
+		t.Errorf("ddg.retries = %v, want 1", retries)
+	}
+	if got := len(spansByName(spans, "ddg.vqd")); got != 2 {
+		t.Errorf("got %d ddg.vqd spans, want 2", got)
+	}
+	if chat.Status.Code == codes.Error {
+		t.Errorf("ddg.chat has error status after a successful retry")
+	}
+}
+
+func TestChatSpansUpstreamError(t *testing.T) {
+	exporter := recordSpans(t)
+	config := stubConfig(newStubUpstream(t, map[string]http.HandlerFunc{
+		"/duckchat/v1/chat": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		},
+	}))
+
+	if _, err := collectChat(t, config, []ChatMessage{{Role: "user", Content: "hi"}}); err == nil {
+		t.Fatal("chat succeeded, want an upstream error")
+	}
+
+	spans := exporter.GetSpans()
+	chat := onlySpan(t, spans, "ddg.chat")
+	if chat.Status.Code != codes.Error {
+		t.Errorf("ddg.chat status = %v, want error", chat.Status.Code)
+	}
+	if span := onlySpan(t, spans, "POST /duckchat/v1/chat"); span.Status.Code != codes.Error {
+		t.Errorf("POST /duckchat/v1/chat status = %v, want error", span.Status.Code)
+	}
+	if len(spansByName(spans, "ddg.chat.stream")) != 0 {
+		t.Error("ddg.chat.stream started for a failed request")
+	}
+}
+
+func TestChatSpansVQDError(t *testing.T) {
+	exporter := recordSpans(t)
+	config := stubConfig(newStubUpstream(t, map[string]http.HandlerFunc{
+		"/duckchat/v1/status": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		},
+	}))
+
+	if _, err := collectChat(t, config, []ChatMessage{{Role: "user", Content: "hi"}}); err == nil {
+		t.Fatal("chat succeeded without a VQD token")
+	}
+
+	spans := exporter.GetSpans()
+	vqd := onlySpan(t, spans, "ddg.vqd")
+	chat := onlySpan(t, spans, "ddg.chat")
+	if vqd.Status.Code != codes.Error || chat.Status.Code != codes.Error {
+		t.Errorf("statuses ddg.vqd = %v, ddg.chat = %v, want both error", vqd.Status.Code, chat.Status.Code)
+	}
+	if vqd.Parent.SpanID() != chat.SpanContext.SpanID() {
+		t.Error("ddg.vqd is not a child of ddg.chat")
+	}
+}
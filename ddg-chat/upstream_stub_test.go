@@ -0,0 +1,73 @@
+package ddgchat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newStubUpstream starts a fake DuckDuckGo API. The VQD endpoints succeed
+// and the chat endpoint replies "hello world" unless handlers replace them.
+func newStubUpstream(t testing.TB, handlers map[string]http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	routes := map[string]http.HandlerFunc{
+		"/country.json": func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"country":"US"}`)
+		},
+		"/duckchat/v1/status": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("x-vqd-4", "stub-vqd")
+			fmt.Fprint(w, `{"status":"0"}`)
+		},
+		"/duckchat/v1/chat": func(w http.ResponseWriter, r *http.Request) {
+			writeChatEvents(w, "hello", " world")
+		},
+	}
+	for path, handler := range handlers {
+		routes[path] = handler
+	}
+	for path, handler := range routes {
+		mux.HandleFunc(path, handler)
+	}
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// writeChatEvents writes messages the way the DuckDuckGo chat stream does.
+func writeChatEvents(w http.ResponseWriter, messages ...string) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	for _, message := range messages {
+		data, _ := json.Marshal(map[string]string{"message": message})
+		fmt.Fprintf(w, "data: %s\n\n", data)
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+// stubConfig returns the default config pointed at server.
+func stubConfig(server *httptest.Server) *Config {
+	config := DefaultConfig()
+	config.DDGChatAPIURL = server.URL
+	return config
+}
+
+// collectChat runs chatWithDuckDuckGo and returns the reply.
+func collectChat(t testing.TB, config *Config, history []ChatMessage) (string, error) {
+	t.Helper()
+	channel := make(chan string)
+	done := make(chan string)
+	go func() {
+		var reply string
+		for chunk := range channel {
+			reply += chunk
+		}
+		done <- reply
+	}()
+	err := chatWithDuckDuckGo(context.Background(), history[len(history)-1].Content, "ddg/gpt-4o-mini", history, channel, config)
+	close(channel)
+	return <-done, err
+}
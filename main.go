@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"os"
 	"os/signal"
 	"syscall"
@@ -26,23 +27,25 @@ func init() {
 
 // graceful shutdown
 func gracefulShutdown() {
-	logger.Info("Shutting down...")
 	logger.SyncLogs()
 	logger.Close()
 }
 
 func main() {
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	go func() {
-		<-signalChan
-		gracefulShutdown()
-		os.Exit(0)
+		<-ctx.Done()
+		// 恢复默认的信号处理，关闭过程中再次收到信号会直接退出
+		stop()
 	}()
 
-	if err := cmd.Execute(version, buildTime, gitCommit); err != nil {
+	if err := cmd.Execute(ctx, version, buildTime, gitCommit); err != nil {
 		logger.Error("Failed to execute root command", zap.Error(err))
+		gracefulShutdown()
 		os.Exit(1)
 	}
+
+	gracefulShutdown()
 }